@@ -0,0 +1,190 @@
+// Package events defines the envelopes published to a room's channel whenever something in the room changes.
+// Consumers should use Decode to read them off the channel.
+package events
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Version is bumped whenever the envelope or a payload changes in a way older consumers can't read
+const Version = 1
+
+type Type string
+
+const (
+	SongAdded       Type = "song-added"
+	QueueReordered  Type = "queue-reordered"
+	SongLiked       Type = "song-liked"
+	SongDisliked    Type = "song-disliked"
+	SongUnliked     Type = "song-unliked"    // a like was taken back
+	SongUndisliked  Type = "song-undisliked" // a dislike was taken back
+	SongAdvanced    Type = "song-advanced"
+	SkipVoted       Type = "skip-voted"
+	UserJoined      Type = "user-joined"
+	SettingsChanged Type = "settings-changed"
+	SessionEnded    Type = "session-ended"
+	CoHostsChanged  Type = "co-hosts-changed"
+	HostChanged     Type = "host-changed"
+	UserKicked      Type = "user-kicked"
+	UserLeft        Type = "user-left"
+)
+
+var (
+	ErrUnsupportedVersion = func(version int) error {
+		return fmt.Errorf("unsupported event version %d | this consumer understands up to version %d", version, Version)
+	}
+	ErrMissingType = fmt.Errorf("event is missing a type")
+)
+
+// Event is the envelope every room update is wrapped in
+type Event struct {
+	ID        string          `json:"id,omitempty"` // position in the room's event log, set once the event has been logged
+	Version   int             `json:"version"`
+	Type      Type            `json:"type"`
+	RoomID    string          `json:"roomID"`
+	Actor     string          `json:"actor,omitempty"` // username of whoever caused the change
+	Timestamp int64           `json:"timestamp"`       // unix milliseconds
+	Payload   json.RawMessage `json:"payload,omitempty"`
+}
+
+// Payloads only carry what changed so clients can patch their local state
+
+type SongAddedPayload struct {
+	SongID    string `json:"songID"`
+	CatalogID string `json:"catalogID"` // the same for every add of this track, in any room
+	Title     string `json:"title"`
+	Artist    string `json:"artist"`
+	Album     string `json:"album"`
+	AddedBy   string `json:"addedBy"`
+}
+
+type QueueReorderedPayload struct {
+	Order []string `json:"order"` // song IDs in their new order
+}
+
+type SongVotePayload struct {
+	SongID   string `json:"songID"`
+	Action   string `json:"action"` // like, un-like, dislike, un-dislike
+	Likes    int    `json:"likes"`  // totals after the vote
+	Dislikes int    `json:"dislikes"`
+}
+
+type SongAdvancedPayload struct {
+	PlayedSongID     string `json:"playedSongID"`
+	NowPlayingSongID string `json:"nowPlayingSongID,omitempty"` // empty once the queue runs out
+	Skipped          bool   `json:"skipped,omitempty"`          // the room voted the song off instead of it finishing
+}
+
+type SkipVotedPayload struct {
+	SongID string `json:"songID"`
+	Votes  int    `json:"votes"`
+	Needed int    `json:"needed"` // votes it takes to skip the song
+}
+
+type UserJoinedPayload struct {
+	Username string `json:"username"`
+}
+
+type SettingsChangedPayload struct {
+	RoomName string          `json:"roomName"`
+	MaxUsers int             `json:"maxUsers"`
+	IsPublic bool            `json:"isPublic"`
+	Rules    RulesPayload    `json:"rules"`
+	Ordering OrderingPayload `json:"ordering"`
+	Lifetime int64           `json:"lifetime"` // minutes, counted from the start
+	EndsAt   int64           `json:"endsAt"`   // unix seconds, guest tokens expire at the old end and have to be fetched again by rejoining
+}
+
+// RulesPayload mirrors the room's queue rules, zero means the rule is off
+type RulesPayload struct {
+	MaxPendingPerUser     int     `json:"maxPendingPerUser"`
+	MaxConsecutivePerUser int     `json:"maxConsecutivePerUser"`
+	CooldownSeconds       int     `json:"cooldownSeconds"`
+	SkipVoteShare         float64 `json:"skipVoteShare"`
+}
+
+// OrderingPayload mirrors the room's queue ordering setting
+type OrderingPayload struct {
+	Mode                string `json:"mode"`
+	ByWaitTime          bool   `json:"byWaitTime"`
+	VoteHalfLifeMinutes int    `json:"voteHalfLifeMinutes"`
+}
+
+type SessionEndedPayload struct {
+	Reason string `json:"reason"`
+}
+
+// New builds an event stamped with the current time and the current schema version
+func New(eventType Type, roomID, actor string, payload interface{}) (Event, error) {
+	event := Event{
+		Version:   Version,
+		Type:      eventType,
+		RoomID:    roomID,
+		Actor:     actor,
+		Timestamp: time.Now().UnixMilli(),
+	}
+	if payload != nil {
+		raw, err := json.Marshal(payload)
+		if err != nil {
+			return Event{}, err
+		}
+		event.Payload = raw
+	}
+	return event, nil
+}
+
+func (e Event) Encode() ([]byte, error) {
+	return json.Marshal(e)
+}
+
+// Decode parses an envelope and rejects versions this package doesn't understand
+func Decode(data []byte) (Event, error) {
+	var event Event
+	if err := json.Unmarshal(data, &event); err != nil {
+		return Event{}, err
+	}
+	if event.Version < 1 || event.Version > Version {
+		return Event{}, ErrUnsupportedVersion(event.Version)
+	}
+	if event.Type == "" {
+		return Event{}, ErrMissingType
+	}
+	return event, nil
+}
+
+// DecodePayload unmarshals the event's payload into v, which should be the payload struct matching e.Type
+func (e Event) DecodePayload(v interface{}) error {
+	if len(e.Payload) == 0 {
+		return nil
+	}
+	return json.Unmarshal(e.Payload, v)
+}
+
+type CoHostsChangedPayload struct {
+	CoHosts []CoHostPayload `json:"coHosts"`
+}
+
+// CoHostPayload mirrors storage.CoHost
+type CoHostPayload struct {
+	Username    string   `json:"username"`
+	Permissions []string `json:"permissions"`
+}
+
+type HostChangedPayload struct {
+	HostID         string `json:"hostID"`
+	PreviousHostID string `json:"previousHostID"`
+}
+
+// UserKickedPayload tells the kicked user's client to disconnect and everyone else which songs left the queue
+type UserKickedPayload struct {
+	Username       string   `json:"username"`
+	Banned         bool     `json:"banned"`
+	RemovedSongIDs []string `json:"removedSongIDs"`
+}
+
+// UserLeftPayload says who left the room on their own
+type UserLeftPayload struct {
+	Username string `json:"username"`
+}
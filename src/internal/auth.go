@@ -8,53 +8,159 @@ import (
 	"github.com/google/uuid"
 )
 
-var cfg = GetConfig()
+// secretKey signs tokens. The config is read on first use rather than at startup so packages importing
+// this one can be loaded, e.g. by tests, before the environment is set up.
+func secretKey() []byte {
+	return []byte(GetConfig().JWTSecret)
+}
+
+const (
+	RoleHost   = "Host"
+	RoleCoHost = "CoHost" // a guest the host handed some permissions to, see storage.CoHost
+	RoleGuest  = "Guest"
+	RoleUser   = "User" // a logged in account outside of any room, its tokens carry no room_id
+)
+
+const (
+	// access tokens are short lived, clients get new ones with the refresh token they came with
+	AccessTokenLifetime = 15 * time.Minute
+	// how long a login lasts, refreshing starts the clock again
+	UserTokenLifetime = 24 * time.Hour
+)
 
-var secretKey = []byte(cfg.JWTSecret)
+const tokenUseRefresh = "refresh"
+
+var (
+	ErrTokenRevoked     = fmt.Errorf("token has been revoked")
+	ErrNotAccessToken   = fmt.Errorf("refresh tokens can only be used to get a new access token")
+	ErrNotRefreshToken  = fmt.Errorf("not a refresh token")
+	ErrRevocationFailed = fmt.Errorf("could not check whether the token was revoked, please try again")
+)
+
+// Claims are the BeatBus specific claims carried by every token. The jti (RegisteredClaims.ID) is what revocation goes by.
+type Claims struct {
+	Username string `json:"username"`
+	Role     string `json:"role"`
+	RoomID   string `json:"room_id"`
+	TokenUse string `json:"token_use,omitempty"` // "refresh" on refresh tokens, empty on access tokens
+	jwt.RegisteredClaims
+}
+
+// TokenPair is an access token and the refresh token that gets the next pair
+type TokenPair struct {
+	AccessToken      string
+	AccessExpiresAt  time.Time
+	RefreshToken     string
+	RefreshExpiresAt time.Time
+}
 
 type JWTHandler struct{}
 
 func NewJWTHandler() *JWTHandler {
 	return &JWTHandler{}
 }
-func (j *JWTHandler) CreateToken(username, roomID string, exp time.Duration) string {
-	return issueHostToken(username, roomID, exp)
+
+// CreateTokenPair issues an access token and a refresh token that is good for lifetime,
+// for room tokens that is the time the room has left
+func (j *JWTHandler) CreateTokenPair(username, roomID, role string, lifetime time.Duration) TokenPair {
+	var pair TokenPair
+	pair.AccessToken, pair.AccessExpiresAt = issueToken(username, roomID, role, "", min(lifetime, AccessTokenLifetime))
+	pair.RefreshToken, pair.RefreshExpiresAt = issueToken(username, roomID, role, tokenUseRefresh, lifetime)
+	return pair
+}
+
+// VerifyToken checks an access token, refresh tokens and revoked tokens are rejected
+func (j *JWTHandler) VerifyToken(tokenString string) (*Claims, error) {
+	claims, err := verifyToken(tokenString)
+	if err != nil {
+		return nil, err
+	}
+	if claims.TokenUse != "" {
+		return nil, ErrNotAccessToken
+	}
+	return claims, nil
+}
+
+// VerifyRefreshToken checks a refresh token, access tokens and revoked tokens are rejected
+func (j *JWTHandler) VerifyRefreshToken(tokenString string) (*Claims, error) {
+	claims, err := verifyToken(tokenString)
+	if err != nil {
+		return nil, err
+	}
+	if claims.TokenUse != tokenUseRefresh {
+		return nil, ErrNotRefreshToken
+	}
+	return claims, nil
 }
-func (j *JWTHandler) VerifyToken(tokenString string) error {
-	return verifyToken(tokenString)
+
+// RedeemRefreshToken checks a refresh token and uses it up in one step. When the same token is redeemed
+// twice at once only one call gets the claims, the other gets ErrTokenRevoked.
+func (j *JWTHandler) RedeemRefreshToken(tokenString string) (*Claims, error) {
+	claims, err := j.VerifyRefreshToken(tokenString)
+	if err != nil {
+		return nil, err
+	}
+	first, err := revoke(claims)
+	if err != nil {
+		return nil, ErrRevocationFailed
+	}
+	if !first {
+		return nil, ErrTokenRevoked
+	}
+	return claims, nil
+}
+
+// Revoke stops the token with claims from working before it expires
+func (j *JWTHandler) Revoke(claims *Claims) error {
+	_, err := revoke(claims)
+	return err
 }
 
-func issueHostToken(username, roomID string, exp time.Duration) string {
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256,
-		jwt.MapClaims{
-			"username": username,
-			"iat":      time.Now().Unix(),
-			"exp":      time.Now().Add(exp).Unix(),
-			"iss":      "BeatBus",
-			"role":     "Host",
-			"room_id":  roomID,
-		})
+func issueToken(username, roomID, role, use string, exp time.Duration) (string, time.Time) {
+	now := time.Now()
+	claims := Claims{
+		Username: username,
+		Role:     role,
+		RoomID:   roomID,
+		TokenUse: use,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        RandomHash(),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(exp)),
+			Issuer:    "BeatBus",
+		},
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 
-	tokenString, _ := token.SignedString(secretKey)
+	tokenString, _ := token.SignedString(secretKey())
+	track(&claims)
 
-	return tokenString
+	return tokenString, claims.ExpiresAt.Time
 }
 
-func verifyToken(tokenString string) error {
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+func verifyToken(tokenString string) (*Claims, error) {
+	claims := &Claims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
 
-		return secretKey, nil
-	})
+		return secretKey(), nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
 
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	if !token.Valid {
-		return fmt.Errorf("invalid token")
+		return nil, fmt.Errorf("invalid token")
+	}
+	revoked, err := isRevoked(claims)
+	if err != nil {
+		return nil, ErrRevocationFailed
+	}
+	if revoked {
+		return nil, ErrTokenRevoked
 	}
 
-	return nil
+	return claims, nil
 }
 
 func RandomHash() string {
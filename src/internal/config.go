@@ -17,6 +17,7 @@ type Config struct {
 	OutputFileName     string
 	DownloadServerIP   string
 	DownloadServerPort string
+	PublicURL          string // where clients reach this server, used in invite links
 }
 
 var (
@@ -29,13 +30,14 @@ func GetConfig() *Config {
 		_ = godotenv.Load()
 		c = &Config{
 			Port:               must("PORT"),
-			MongoURI:           must("MONGO_URI"),
+			MongoURI:           optional("MONGO_URI"),
 			JWTSecret:          must("JWT_SECRET"),
-			RedisURI:           must("REDIS_URI"),
-			TxtBeltAPIKey:      must("TXT_BELT_API_KEY"),
+			RedisURI:           optional("REDIS_URI"),
+			TxtBeltAPIKey:      optional("TXT_BELT_API_KEY"),
 			OutputFileName:     must("OUTPUT_FILE_NAME"),
-			DownloadServerIP:   must("DOWNLOAD_SERVER_IP"),
-			DownloadServerPort: must("DOWNLOAD_SERVER_PORT"),
+			DownloadServerIP:   optional("DOWNLOAD_SERVER_IP"),
+			DownloadServerPort: optional("DOWNLOAD_SERVER_PORT"),
+			PublicURL:          optional("PUBLIC_URL"),
 		}
 	})
 	if c == nil {
@@ -50,3 +52,8 @@ func must(k string) string {
 	}
 	return v
 }
+
+// optional settings are only needed by some setups, e.g. MONGO_URI and REDIS_URI aren't used with --memory
+func optional(k string) string {
+	return os.Getenv(k)
+}
@@ -0,0 +1,68 @@
+package internal
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidInvite = fmt.Errorf("invite link is invalid")
+	ErrInviteExpired = fmt.Errorf("invite link has expired")
+)
+
+// InviteClaims are what an invite token carries. The room decides whether InviteID is still the current
+// invite and how often it was used, the token only proves the server handed it out.
+type InviteClaims struct {
+	RoomID    string `json:"r"`
+	InviteID  string `json:"i"`
+	ExpiresAt int64  `json:"e"` // unix seconds
+}
+
+// invite tokens are signed with their own key so they can never pass for any other signed value
+func inviteKey() []byte {
+	mac := hmac.New(sha256.New, secretKey())
+	mac.Write([]byte("BeatBus invites"))
+	return mac.Sum(nil)
+}
+
+// SignInvite returns a token for claims, base64url(payload).base64url(HMAC-SHA256(payload))
+func SignInvite(claims InviteClaims) string {
+	payload, _ := json.Marshal(claims)
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(inviteSignature(encoded))
+}
+
+// VerifyInvite checks the signature and expiry of an invite token
+func VerifyInvite(token string) (InviteClaims, error) {
+	encoded, signature, ok := strings.Cut(token, ".")
+	if !ok {
+		return InviteClaims{}, ErrInvalidInvite
+	}
+	got, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(got, inviteSignature(encoded)) {
+		return InviteClaims{}, ErrInvalidInvite
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return InviteClaims{}, ErrInvalidInvite
+	}
+	var claims InviteClaims
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.RoomID == "" || claims.InviteID == "" {
+		return InviteClaims{}, ErrInvalidInvite
+	}
+	if time.Now().Unix() >= claims.ExpiresAt {
+		return InviteClaims{}, ErrInviteExpired
+	}
+	return claims, nil
+}
+
+func inviteSignature(encoded string) []byte {
+	mac := hmac.New(sha256.New, inviteKey())
+	mac.Write([]byte(encoded))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,45 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// bcrypt cost of new password hashes, hashes made with a lower cost are replaced on the next login
+const passwordCost = bcrypt.DefaultCost
+
+// HashPassword returns a salted bcrypt hash of password to store with the user
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), passwordCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// CheckPassword reports whether password matches the stored hash and whether the hash should be
+// replaced with a fresh HashPassword. Accounts made before bcrypt hold an unsalted sha256 hex digest,
+// those still match and are always flagged for a rehash.
+func CheckPassword(hash, password string) (ok, rehash bool) {
+	if isLegacyHash(hash) {
+		digest := sha256.Sum256([]byte(password))
+		return subtle.ConstantTimeCompare([]byte(hex.EncodeToString(digest[:])), []byte(hash)) == 1, true
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return false, false
+	}
+	cost, err := bcrypt.Cost([]byte(hash))
+	return true, err != nil || cost < passwordCost
+}
+
+// isLegacyHash reports whether hash is a sha256 hex digest, bcrypt hashes always start with $
+func isLegacyHash(hash string) bool {
+	if len(hash) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(hash)
+	return err == nil
+}
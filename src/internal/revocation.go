@@ -0,0 +1,84 @@
+package internal
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// TokenStore keeps the IDs of revoked tokens until the tokens would have expired anyway.
+// It also remembers which tokens were issued for a room, so all of them can be revoked at once.
+type TokenStore interface {
+	Revoke(jti string, until time.Time) (bool, error) // false if the token was already revoked or has expired
+	IsRevoked(jti string) (bool, error)
+	Track(group, jti string, until time.Time) error
+	RevokeGroup(group string) error // revokes every token tracked in group
+}
+
+// tokenStore is nil until UseTokenStore is called, tokens then can't be revoked
+var tokenStore TokenStore
+
+// UseTokenStore sets where revoked tokens are kept, call it before any token is issued
+func UseTokenStore(store TokenStore) {
+	tokenStore = store
+}
+
+// tokens issued for a room are tracked in the room's group and in the group of the user in that room
+func roomGroup(roomID string) string {
+	return "room:" + roomID
+}
+
+func userRoomGroup(roomID, username string) string {
+	return fmt.Sprintf("room:%s:user:%s", roomID, username)
+}
+
+func track(claims *Claims) {
+	if tokenStore == nil || claims.RoomID == "" {
+		return
+	}
+	until := claims.ExpiresAt.Time
+	for _, group := range []string{roomGroup(claims.RoomID), userRoomGroup(claims.RoomID, claims.Username)} {
+		if err := tokenStore.Track(group, claims.ID, until); err != nil {
+			// the token still works, it just can't be revoked along with the room
+			log.Printf("failed to track token %s in %s: %v\n", claims.ID, group, err)
+		}
+	}
+}
+
+// revoke reports whether this call revoked the token, only one of several racing calls gets true.
+// Without a token store nothing is revoked and every call gets true.
+func revoke(claims *Claims) (bool, error) {
+	if tokenStore == nil || claims.ID == "" {
+		return true, nil
+	}
+	return tokenStore.Revoke(claims.ID, claims.ExpiresAt.Time)
+}
+
+// IsRevoked reports whether the token the claims came from was revoked after it was verified,
+// long lived connections use it to notice a kick or a host handoff
+func IsRevoked(claims *Claims) (bool, error) {
+	return isRevoked(claims)
+}
+
+func isRevoked(claims *Claims) (bool, error) {
+	if tokenStore == nil || claims.ID == "" {
+		return false, nil
+	}
+	return tokenStore.IsRevoked(claims.ID)
+}
+
+// RevokeRoomTokens revokes every token issued for the room, used when the session ends
+func RevokeRoomTokens(roomID string) error {
+	if tokenStore == nil {
+		return nil
+	}
+	return tokenStore.RevokeGroup(roomGroup(roomID))
+}
+
+// RevokeUserRoomTokens revokes every token username was issued for the room
+func RevokeUserRoomTokens(roomID, username string) error {
+	if tokenStore == nil {
+		return nil
+	}
+	return tokenStore.RevokeGroup(userRoomGroup(roomID, username))
+}
@@ -2,8 +2,15 @@ package main
 
 import (
 	"BeatBus/server"
+	"flag"
 )
 
 func main() {
+	memory := flag.Bool("memory", false, "keep rooms, users and events in memory instead of Mongo and Redis")
+	flag.Parse()
+	if *memory {
+		server.NewMemoryServer().StartServer()
+		return
+	}
 	server.NewServer().StartServer()
 }
@@ -0,0 +1,41 @@
+package server
+
+import (
+	"BeatBus/storage"
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+// PublicRooms lists the public rooms anyone can join, no token needed.
+// ?search= matches the room name, ?sort=popular|newest and ?limit= / ?offset= page through the rest.
+func (s *Server) PublicRooms(w http.ResponseWriter, r *http.Request) {
+	query := storage.PublicRoomQuery{
+		Search: r.URL.Query().Get("search"),
+		Sort:   r.URL.Query().Get("sort"),
+	}
+	for param, value := range map[string]*int{"limit": &query.Limit, "offset": &query.Offset} {
+		raw := r.URL.Query().Get(param)
+		if raw == "" {
+			continue
+		}
+		parsed, err := strconv.Atoi(raw)
+		if err != nil {
+			http.Error(w, param+" must be a number", http.StatusBadRequest)
+			return
+		}
+		*value = parsed
+	}
+	page, err := s.rooms.PublicRooms(query)
+	if err != nil {
+		switch err {
+		case storage.ErrInvalidRoomSort, storage.ErrInvalidRoomPage:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"BeatBus/internal"
 	pb "BeatBus/internal/grpc"
 	"context"
 	"fmt"
@@ -18,6 +19,10 @@ func NewDownloadQueue() *DownloadQueue {
 
 // Send GRPC call to download song from youtube to S3 bucket
 func (dq *DownloadQueue) RetrieveSong(s AddSongRequest) {
+	cfg := internal.GetConfig()
+	if cfg.DownloadServerIP == "" {
+		return // no download server configured, e.g. when running with --memory
+	}
 	conn, err := grpc.NewClient(fmt.Sprintf("%s:%s", cfg.DownloadServerIP, cfg.DownloadServerPort), grpc.WithTransportCredentials(insecure.NewCredentials()))
 	if err != nil {
 		return
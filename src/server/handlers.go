@@ -1,25 +1,28 @@
 package server
 
 import (
+	"BeatBus/events"
 	"BeatBus/internal"
 	"BeatBus/storage"
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"slices"
 	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
 )
 
 /* in the future we could make all of these methods of the server struct so that all the logs go to the same place but the doesnt matter too much*/
 var (
 	SameSongTimeout        = time.Second * 60 * 5 // user must wait atleast 5 minutes before making a song request again
 	SongInteractionTimeout = time.Second * 3      // user must wait atleast 3 seconds before liking/disliking a song again
-	genericCheckUpdates    = 1
-	endSession             = 0
 )
 
 func hashStrings(input string) string {
@@ -30,6 +33,19 @@ func channelString(roomID string) string {
 	return fmt.Sprintf("room-%s", roomID)
 }
 
+// publishEvent wraps a change in a versioned envelope and publishes it to everyone listening on the room's channel.
+// It returns once the event is logged and published, so the events of one request reach the room in the order they were published.
+func (s *Server) publishEvent(roomID string, eventType events.Type, actor string, payload interface{}) {
+	event, err := events.New(eventType, roomID, actor, payload)
+	if err != nil {
+		s.logger.Printf("failed to build %s event for room %s: %v\n", eventType, roomID, err)
+		return
+	}
+	if err := s.bus.UpdateChannel(channelString(roomID), event); err != nil {
+		s.logger.Printf("failed to publish %s event for room %s: %v\n", eventType, roomID, err)
+	}
+}
+
 // Authentication
 func (s *Server) SignUp(w http.ResponseWriter, r *http.Request) {
 	var reqBody AuthRequest
@@ -43,7 +59,7 @@ func (s *Server) SignUp(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Username and password are required", http.StatusBadRequest)
 		return
 	}
-	err = storage.NewDocumentStore(s.documentLogger).InsertNewUser(reqBody.Username, hashStrings(reqBody.Password))
+	err = s.users.InsertNewUser(reqBody.Username, reqBody.Password)
 	if err != nil {
 		if err == storage.ErrUserNameTaken {
 			http.Error(w, "Username already taken", http.StatusConflict)
@@ -68,13 +84,107 @@ func (s *Server) LogIn(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Username and password are required", http.StatusBadRequest)
 		return
 	}
-	err = storage.NewDocumentStore(s.documentLogger).ValidateUser(reqBody.Username, hashStrings(reqBody.Password))
+	err = s.users.ValidateUser(reqBody.Username, reqBody.Password)
 	if err != nil {
-		http.Error(w, "[Invalid Creds] "+err.Error(), http.StatusUnauthorized)
+		if err == storage.ErrInvalidCredentials {
+			http.Error(w, "[Invalid Creds] "+err.Error(), http.StatusUnauthorized)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("Login successful"))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(LogInResponse{
+		Username:    reqBody.Username,
+		AccessToken: tokenResponse(internal.NewJWTHandler().CreateTokenPair(reqBody.Username, "", internal.RoleUser, internal.UserTokenLifetime)),
+	})
+}
+
+// RefreshToken trades a refresh token for a new token pair. The refresh token is used up, so a stolen one
+// stops working as soon as either side refreshes. Room tokens come back with the role the user has in the room now.
+func (s *Server) RefreshToken(w http.ResponseWriter, r *http.Request) {
+	var reqBody RefreshTokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil || reqBody.RefreshToken == "" {
+		http.Error(w, "refreshToken is required", http.StatusBadRequest)
+		return
+	}
+	jwtHandler := internal.NewJWTHandler()
+	// verified and used up in one step, a second refresh with the same token gets a 401
+	claims, err := jwtHandler.RedeemRefreshToken(reqBody.RefreshToken)
+	if err != nil {
+		if err == internal.ErrRevocationFailed {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		http.Error(w, "[Invalid Token] "+err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if claims.RoomID == "" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"username":    claims.Username,
+			"accessToken": tokenResponse(jwtHandler.CreateTokenPair(claims.Username, "", internal.RoleUser, internal.UserTokenLifetime)),
+		})
+		return
+	}
+	token, role, err := s.rooms.RoomToken(claims.RoomID, claims.Username)
+	if err != nil {
+		switch err {
+		case storage.ErrRoomDoesntExist, storage.ErrUserNotInRoom:
+			http.Error(w, "[Invalid Token] "+err.Error(), http.StatusUnauthorized)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"username":    claims.Username,
+		"roomID":      claims.RoomID,
+		"role":        role.Role,
+		"permissions": role.Permissions,
+		"accessToken": token,
+	})
+}
+
+// RevokeToken logs the caller out: the bearer token and the refresh token in the body, if any, stop working
+func (s *Server) RevokeToken(w http.ResponseWriter, r *http.Request) {
+	claims, ok := claimsFromContext(r)
+	if !ok {
+		http.Error(w, "[Invalid Token] a bearer token is required", http.StatusUnauthorized)
+		return
+	}
+	var reqBody RefreshTokenRequest
+	json.NewDecoder(r.Body).Decode(&reqBody) // the body is optional
+	jwtHandler := internal.NewJWTHandler()
+	revoke := []*internal.Claims{claims}
+	if reqBody.RefreshToken != "" {
+		refreshClaims, err := jwtHandler.VerifyRefreshToken(reqBody.RefreshToken)
+		if err == nil && refreshClaims.Username != claims.Username {
+			http.Error(w, "[Forbidden] the refresh token was issued to another user", http.StatusForbidden)
+			return
+		}
+		if err == nil {
+			revoke = append(revoke, refreshClaims)
+		}
+	}
+	for _, c := range revoke {
+		if err := jwtHandler.Revoke(c); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// tokenResponse is how token pairs are sent to clients, the same shape as storage.AccessToken
+func tokenResponse(pair internal.TokenPair) JWT_AccessToken {
+	return JWT_AccessToken{
+		Token:            pair.AccessToken,
+		ExpiresIn:        pair.AccessExpiresAt.Unix(),
+		RefreshToken:     pair.RefreshToken,
+		RefreshExpiresIn: pair.RefreshExpiresAt.Unix(),
+	}
 }
 
 // Rooms
@@ -84,17 +194,54 @@ func (s *Server) JoinRoom(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Missing roomID parameter", http.StatusBadRequest)
 		return
 	}
+	// an invite link stands in for the password, public rooms need neither
 	roomPassword := r.URL.Query().Get("roomPassword")
-	if roomPassword == "" {
-		http.Error(w, "Missing roomPassword parameter", http.StatusBadRequest)
-		return
+	inviteToken := r.URL.Query().Get("invite")
+	var invite internal.InviteClaims
+	if inviteToken != "" {
+		var err error
+		invite, err = internal.VerifyInvite(inviteToken)
+		if err == internal.ErrInviteExpired {
+			http.Error(w, "[Gone] "+err.Error()+", ask the host for a new one", http.StatusGone)
+			return
+		}
+		if err != nil || invite.RoomID != roomID {
+			http.Error(w, "[Invalid Invite] the invite link is not valid for this room", http.StatusUnauthorized)
+			return
+		}
 	}
 	username := r.URL.Query().Get("username")
+	// logged in users join under their account, anyone else just picks a name
+	claims, hasToken := claimsFromContext(r)
+	if hasToken {
+		if username != "" && username != claims.Username {
+			http.Error(w, "[Forbidden] your token was issued to another user", http.StatusForbidden)
+			return
+		}
+		username = claims.Username
+	}
 	if username == "" {
 		http.Error(w, "Missing username parameter", http.StatusBadRequest)
 		return
 	}
-	err := storage.NewDocumentStore(s.documentLogger).AddUserToRoom(roomID, roomPassword, username)
+	if !hasToken {
+		registered, err := s.users.UserExists(username)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if registered {
+			http.Error(w, fmt.Sprintf("[Invalid Token] %s is a registered user, log in to join as them", username), http.StatusUnauthorized)
+			return
+		}
+	}
+	var timeLeft time.Duration
+	var err error
+	if inviteToken != "" {
+		timeLeft, err = s.rooms.AddUserWithInvite(roomID, invite.InviteID, username)
+	} else {
+		timeLeft, err = s.rooms.AddUserToRoom(roomID, roomPassword, username)
+	}
 	if err != nil {
 		switch err {
 		case storage.ErrRoomDoesntExist:
@@ -103,22 +250,61 @@ func (s *Server) JoinRoom(w http.ResponseWriter, r *http.Request) {
 		case storage.ErrInvalidRoomPassword:
 			http.Error(w, "[The Room Password you provided is incorrect] -> please try again or contact the room host", http.StatusUnauthorized)
 			return
+		case storage.ErrRoomIsPrivate:
+			http.Error(w, "Missing roomPassword or invite parameter, "+err.Error(), http.StatusUnauthorized)
+			return
+		case storage.ErrInviteReplaced, storage.ErrInviteUsedUp, internal.ErrInviteExpired:
+			http.Error(w, "[Gone] "+err.Error(), http.StatusGone)
+			return
 		case storage.ErrRoomFull:
 			http.Error(w, "[The Room you are attempting to join is full] -> please try again later or contact the room host", http.StatusForbidden)
 			return
+		case storage.ErrRoomExpired:
+			http.Error(w, "[The Room you are attempting to join has already ended]", http.StatusGone)
+			return
+		case storage.ErrUserBanned:
+			http.Error(w, "[Forbidden] "+err.Error(), http.StatusForbidden)
+			return
 		case storage.ErrUserAlreadyInRoom:
-			w.WriteHeader(http.StatusNoContent)
-			w.Write([]byte("User already in room"))
+			// rejoining (e.g. after a page reload) hands out a fresh token for their role, as long as it's really them
+			if !hasToken {
+				http.Error(w, "[Conflict] someone in the room already goes by that name, pick another one or rejoin with your token", http.StatusConflict)
+				return
+			}
 		default:
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
 	}
-	resp := map[string]string{
+	resp := map[string]interface{}{
 		"username": username,
 		"roomID":   roomID,
-		"message":  "Successfully joined room",
+	}
+	if err == nil {
+		s.publishEvent(roomID, events.UserJoined, username, events.UserJoinedPayload{Username: username})
+		resp["message"] = "Successfully joined room"
+		resp["role"] = internal.RoleGuest
+		// guest refresh tokens live exactly as long as the room does
+		resp["accessToken"] = tokenResponse(internal.NewJWTHandler().CreateTokenPair(username, roomID, internal.RoleGuest, timeLeft))
+	} else {
+		// a host or co-host who rejoins keeps their role
+		token, role, err := s.rooms.RoomToken(roomID, username)
+		if err != nil {
+			switch err {
+			case storage.ErrRoomDoesntExist:
+				http.Error(w, fmt.Sprintf("Room with ID [ %s ] does not exist", roomID), http.StatusNotFound)
+			case storage.ErrUserNotInRoom:
+				http.Error(w, "[Conflict] you left the room while rejoining, please try again", http.StatusConflict)
+			default:
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+		resp["message"] = "User already in room"
+		resp["role"] = role.Role
+		resp["permissions"] = role.Permissions
+		resp["accessToken"] = token
 	}
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(resp)
@@ -126,6 +312,11 @@ func (s *Server) JoinRoom(w http.ResponseWriter, r *http.Request) {
 func (s *Server) Rooms(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "POST":
+		// the host is whoever logged in, not whoever the body claims to be
+		claims, ok := requireRole(w, r, internal.RoleUser)
+		if !ok {
+			return
+		}
 		var reqBody CreateRoomRequest
 		// Parse the JSON request body
 		err := json.NewDecoder(r.Body).Decode(&reqBody)
@@ -133,12 +324,23 @@ func (s *Server) Rooms(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "Invalid request body", http.StatusBadRequest)
 			return
 		}
-		if reqBody.HostUserName == "" || reqBody.RoomName == "" || reqBody.LifeTime <= 0 || reqBody.LifeTime > 300 || reqBody.MaxUsers <= 0 {
-			http.Error(w, "HostUserName, RoomName, LifeTime and MaxUsers are required and must be greater than 0. Lifetime must be between 1 and 300 (minutes)", http.StatusBadRequest)
+		if reqBody.RoomName == "" || reqBody.LifeTime <= 0 || reqBody.LifeTime > storage.MaxRoomLifetime || reqBody.MaxUsers <= 0 {
+			http.Error(w, fmt.Sprintf("RoomName, LifeTime and MaxUsers are required and must be greater than 0. Lifetime must be between 1 and %d (minutes)", storage.MaxRoomLifetime), http.StatusBadRequest)
+			return
+		}
+		if err := reqBody.Rules.Validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := reqBody.Ordering.Validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		storage := storage.NewDocumentStore(s.documentLogger)
-		res, err := storage.CreateRoom(reqBody.HostUserName, reqBody.RoomName, uint(reqBody.LifeTime), uint(reqBody.MaxUsers), reqBody.IsPublic)
+		var startsAt time.Time
+		if reqBody.StartsAt != 0 {
+			startsAt = time.Unix(reqBody.StartsAt, 0)
+		}
+		res, err := s.rooms.CreateRoom(claims.Username, reqBody.RoomName, uint(reqBody.LifeTime), uint(reqBody.MaxUsers), reqBody.IsPublic, reqBody.Rules, reqBody.Ordering, startsAt)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
@@ -148,104 +350,344 @@ func (s *Server) Rooms(w http.ResponseWriter, r *http.Request) {
 		s.logger.Printf("Received CreateRoom request: %+v\n", reqBody)
 
 	case "PUT":
-		err := jwtValidation(*r)
-		if err != nil {
-			http.Error(w, "[Invalid Token] "+err.Error(), http.StatusUnauthorized)
+		claims, ok := requireRole(w, r, internal.RoleHost)
+		if !ok {
 			return
 		}
 		var reqBody CreateRoomRequest
-		err = json.NewDecoder(r.Body).Decode(&reqBody)
+		err := json.NewDecoder(r.Body).Decode(&reqBody)
 		if err != nil {
 			http.Error(w, "Invalid request body", http.StatusBadRequest)
 			return
 		}
-		if reqBody.HostUserName == "" || reqBody.RoomName == "" || reqBody.MaxUsers <= 0 {
-			http.Error(w, "HostUserName, RoomName, LifeTime and MaxUsers are required and must be greater than 0. Lifetime must be between 1 and 300 (minutes)", http.StatusBadRequest)
+		if reqBody.RoomName == "" || reqBody.MaxUsers <= 0 || reqBody.LifeTime < 0 {
+			http.Error(w, fmt.Sprintf("RoomName and MaxUsers are required and MaxUsers must be greater than 0. LifeTime is optional, it moves the end of the room and must leave it between 1 and %d minutes to run", storage.MaxRoomLifetime), http.StatusBadRequest)
 			return
 		}
-		response, err := storage.NewDocumentStore(s.documentLogger).UpdateRoomSettings(reqBody.HostUserName, reqBody.RoomName, uint(reqBody.MaxUsers), reqBody.IsPublic)
-		if err != nil {
+		if err := reqBody.Rules.Validate(); err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		roomid := response["roomProps"].(map[string]interface{})["roomID"].(string)
-		for k, v := range response {
-			s.logger.Printf("response[%s]: %v\n", k, v)
-		}
-		if response["roomProps"].(map[string]interface{})["timeLeft"].(int64) <= 0 {
-			go storage.NewMessageQueue(s.cacheLogger).UpdateChannel(channelString(roomid), endSession) // notify all users in this room that the room has been closed
-		} else {
-			// notify all users in this room that the room settings have been updated
-			go storage.NewMessageQueue(s.cacheLogger).UpdateChannel(channelString(roomid), genericCheckUpdates)
-		}
-		json.NewEncoder(w).Encode(response)
-	case "DELETE":
-		// Delete a room
-		err := jwtValidation(*r)
-		if err != nil {
-			http.Error(w, "[Invalid Token] "+err.Error(), http.StatusUnauthorized)
+		if err := reqBody.Ordering.Validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		var reqBody DeleteRoomRequest
-		err = json.NewDecoder(r.Body).Decode(&reqBody)
+		// the room is the one the host token was issued for
+		response, err := s.rooms.UpdateRoomSettings(claims.RoomID, claims.Username, reqBody.RoomName, uint(reqBody.LifeTime), uint(reqBody.MaxUsers), reqBody.IsPublic, reqBody.Rules, reqBody.Ordering)
 		if err != nil {
-			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			switch err {
+			case storage.ErrRoomDoesntExist:
+				http.Error(w, err.Error(), http.StatusNotFound)
+			case storage.ErrNotRoomHost:
+				http.Error(w, "[Forbidden] you can only update the settings of a room you are hosting", http.StatusForbidden)
+			case storage.ErrConcurrentRoomUpdate:
+				http.Error(w, err.Error(), http.StatusConflict)
+			default:
+				http.Error(w, err.Error(), http.StatusBadRequest)
+			}
 			return
 		}
-		if reqBody.HostUsername == "" || reqBody.RoomID == "" || reqBody.AccessToken == "" {
-			http.Error(w, "hostUsername, roomID and accessToken are required", http.StatusBadRequest)
+		roomid := response.RoomProps.RoomID
+		s.logger.Printf("response: %+v\n", response)
+		// the room is still running, UpdateRoomSettings rejects lifetimes that would end it
+		// and rooms that run out are ended by EndExpiredRooms
+		s.publishEvent(roomid, events.SettingsChanged, claims.Username, events.SettingsChangedPayload{
+			RoomName: reqBody.RoomName,
+			MaxUsers: reqBody.MaxUsers,
+			IsPublic: reqBody.IsPublic,
+			Rules:    events.RulesPayload(reqBody.Rules),
+			Ordering: events.OrderingPayload(reqBody.Ordering),
+			Lifetime: response.RoomProps.Lifetime,
+			EndsAt:   response.RoomProps.StartsAt + response.RoomProps.Lifetime*60,
+		})
+		json.NewEncoder(w).Encode(response)
+	case "DELETE":
+		// Delete the room the host token was issued for
+		claims, ok := requireRole(w, r, internal.RoleHost)
+		if !ok {
 			return
 		}
-		s.logger.Printf("received DELETE request for room: %+v\n", reqBody)
-		// TODO: This should return a map[string]interface{} with the most liked user and other stats
-		endSessionResults, err := storage.NewDocumentStore(s.documentLogger).DeleteRoom(reqBody.AccessToken, reqBody.HostUsername, reqBody.RoomID)
+		roomID := claims.RoomID
+		s.logger.Printf("received DELETE request for room %s from %s\n", roomID, claims.Username)
+		endSessionResults, err := s.rooms.DeleteRoom(claims.Username, roomID)
 		if err != nil {
 			if err == storage.ErrRoomDoesntExist {
-				http.Error(w, fmt.Sprintf("[The Room you are attempting to delete doesn't exist] -> %s \n check that you have permission to delete this room and that the provided information is correct. \n You may have already deleted this", reqBody.RoomID), http.StatusNotFound)
+				http.Error(w, fmt.Sprintf("[The Room you are attempting to delete doesn't exist] -> %s \n check that you have permission to delete this room and that the provided information is correct. \n You may have already deleted this", roomID), http.StatusNotFound)
+				return
+			}
+			if err == storage.ErrConcurrentRoomUpdate {
+				http.Error(w, err.Error(), http.StatusConflict)
 				return
 			}
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		go storage.NewMessageQueue(s.cacheLogger).UpdateChannel(channelString(reqBody.RoomID), endSession) // notify all users in this room that the room has been closed
+		// notify all users in this room that the room has been closed
+		s.publishEvent(roomID, events.SessionEnded, claims.Username, events.SessionEndedPayload{Reason: storage.SessionEndedByHost})
 		json.NewEncoder(w).Encode(endSessionResults)
 	}
 }
 
-// TODO:  This needs to be implemented using websock so that the client can get real time updates
+// RoomState upgrades the connection to a websocket, sends the full room state on connect
+// and pushes every room event along with a fresh snapshot as it happens.
+// Clients reconnecting with ?lastEventID= are first sent the events they missed.
 func (s *Server) RoomState(w http.ResponseWriter, r *http.Request) {
 	roomID := mux.Vars(r)["roomID"]
 	if roomID == "" {
 		http.Error(w, "Missing roomID parameter", http.StatusBadRequest)
 		return
 	}
-	roomPassword := r.URL.Query().Get("roomPassword")
-	if roomPassword == "" {
-		http.Error(w, "Missing roomPassword parameter", http.StatusBadRequest)
+	if !s.roomAccess(w, r, roomID) {
 		return
 	}
-	if !storage.NewDocumentStore(s.documentLogger).RoomExist(roomID) {
+	if !s.rooms.RoomExist(roomID) {
 		http.Error(w, fmt.Sprintf("Room with ID [ %s ] does not exist", roomID), http.StatusNotFound)
 		return
 	}
-	pubSub := storage.NewMessageQueue(s.cacheLogger).SubscribeChannel(channelString(roomID))
-	defer pubSub.Close()
-	msg := <-pubSub.Channel()
-	s.logger.Printf("Received message from channel %s: %s\n", msg.Channel, msg.Payload)
-	switch msg.Payload {
-	case "1":
-		roomState, err := storage.NewDocumentStore(s.documentLogger).RoomState(roomID)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+	// subscribe before catching up so no update can slip in between the two
+	sub, err := s.bus.SubscribeChannel(channelString(roomID))
+	if err != nil {
+		http.Error(w, "Unable to subscribe to room updates", http.StatusInternalServerError)
+		return
+	}
+	defer sub.Close()
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade already replied to the client with an error
+		s.logger.Printf("failed to upgrade connection for room %s: %v\n", roomID, err)
+		return
+	}
+	defer conn.Close()
+
+	backlog, caughtUpTo, err := s.catchUp(roomID, lastEventID(r))
+	if err != nil {
+		closeWithReason(conn, websocket.CloseInternalServerErr, err.Error())
+		return
+	}
+	for _, message := range backlog {
+		if err := writeMessage(conn, message.Message); err != nil {
 			return
 		}
-		json.NewEncoder(w).Encode(roomState)
+	}
+
+	clientGone := readPump(conn)
+	ticker := time.NewTicker(wsPingPeriod)
+	defer ticker.Stop()
+	presence, stopPresence := s.streamPresence(r, roomID)
+	defer stopPresence()
+	updates := sub.Events()
+	for {
+		select {
+		case <-clientGone:
+			s.logger.Printf("client disconnected from room %s\n", roomID)
+			return
+		case <-ticker.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait)); err != nil {
+				return
+			}
+		case <-presence:
+			if reason := s.recheckStream(r, roomID); reason != "" {
+				closeWithReason(conn, websocket.ClosePolicyViolation, reason)
+				return
+			}
+		case event, ok := <-updates:
+			if !ok {
+				closeWithReason(conn, websocket.CloseGoingAway, "room updates are no longer available")
+				return
+			}
+			s.logger.Printf("Received %s event %s for room %s\n", event.Type, event.ID, roomID)
+			// events logged before the catch up are in the replay or the snapshot already. Later ones are always
+			// sent, even if they come in out of order because two requests published to the room at once
+			if alreadySent(event.ID, caughtUpTo) {
+				continue
+			}
+			if event.Type == events.SessionEnded {
+				writeMessage(conn, streamMessage{Event: &event})
+				closeWithReason(conn, websocket.CloseNormalClosure, sessionEndedReason(event))
+				return
+			}
+			// a kicked user is sent the kick and then cut off, without the state that follows it
+			if changesAccess(event) {
+				if reason := s.streamAccess(r, roomID); reason != "" {
+					writeMessage(conn, streamMessage{Event: &event})
+					closeWithReason(conn, websocket.ClosePolicyViolation, reason)
+					return
+				}
+			}
+			roomState, err := s.rooms.RoomState(roomID)
+			if err != nil {
+				closeWithReason(conn, websocket.CloseInternalServerErr, err.Error())
+				return
+			}
+			if err := writeMessage(conn, streamMessage{Event: &event, State: roomState}); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// RoomEvents streams the room's events as Server-Sent Events for clients that can't open a websocket.
+// Every live event carries a fresh room state snapshot so the client never has to re-poll.
+func (s *Server) RoomEvents(w http.ResponseWriter, r *http.Request) {
+	roomID := mux.Vars(r)["roomID"]
+	if roomID == "" {
+		http.Error(w, "Missing roomID parameter", http.StatusBadRequest)
 		return
-	case "0":
-		w.WriteHeader(http.StatusOK)
-		_, _ = w.Write([]byte("end session"))
+	}
+	if !s.roomAccess(w, r, roomID) {
+		return
+	}
+	if !s.rooms.RoomExist(roomID) {
+		http.Error(w, fmt.Sprintf("Room with ID [ %s ] does not exist", roomID), http.StatusNotFound)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	sub, err := s.bus.SubscribeChannel(channelString(roomID))
+	if err != nil {
+		http.Error(w, "Unable to subscribe to room updates", http.StatusInternalServerError)
+		return
+	}
+	defer sub.Close()
+
+	backlog, caughtUpTo, err := s.catchUp(roomID, lastEventID(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no") // stop nginx style proxies from buffering the stream
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", sseRetry.Milliseconds())
+	for _, message := range backlog {
+		if err := writeSSE(w, flusher, message.ID, message.Name, message.Message); err != nil {
+			return
+		}
+	}
+
+	keepAlive := time.NewTicker(sseKeepAlive)
+	defer keepAlive.Stop()
+	presence, stopPresence := s.streamPresence(r, roomID)
+	defer stopPresence()
+	updates := sub.Events()
+	for {
+		select {
+		case <-r.Context().Done():
+			s.logger.Printf("SSE client disconnected from room %s\n", roomID)
+			return
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-presence:
+			if reason := s.recheckStream(r, roomID); reason != "" {
+				writeSSE(w, flusher, "", "access-revoked", reason)
+				return
+			}
+		case event, ok := <-updates:
+			if !ok {
+				return
+			}
+			// events logged before the catch up are in the replay or the snapshot already. Later ones are always
+			// sent, even if they come in out of order because two requests published to the room at once
+			if alreadySent(event.ID, caughtUpTo) {
+				continue
+			}
+			if event.Type == events.SessionEnded {
+				writeSSE(w, flusher, event.ID, string(event.Type), streamMessage{Event: &event})
+				return
+			}
+			if changesAccess(event) {
+				if reason := s.streamAccess(r, roomID); reason != "" {
+					writeSSE(w, flusher, event.ID, string(event.Type), streamMessage{Event: &event})
+					writeSSE(w, flusher, "", "access-revoked", reason)
+					return
+				}
+			}
+			roomState, err := s.rooms.RoomState(roomID)
+			if err != nil {
+				writeSSE(w, flusher, event.ID, string(events.SessionEnded), err.Error())
+				return
+			}
+			if err := writeSSE(w, flusher, event.ID, string(event.Type), streamMessage{Event: &event, State: roomState}); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// RoomEventLog returns the room's logged events that came after the ?after= event ID so late joiners can replay them
+func (s *Server) RoomEventLog(w http.ResponseWriter, r *http.Request) {
+	roomID := mux.Vars(r)["roomID"]
+	if roomID == "" {
+		http.Error(w, "Missing roomID parameter", http.StatusBadRequest)
+		return
+	}
+	if !s.roomAccess(w, r, roomID) {
+		return
+	}
+	if !s.rooms.RoomExist(roomID) {
+		http.Error(w, fmt.Sprintf("Room with ID [ %s ] does not exist", roomID), http.StatusNotFound)
+		return
+	}
+	logged, err := s.bus.ReadEvents(channelString(roomID), r.URL.Query().Get("after"))
+	if err != nil {
+		if err == storage.ErrInvalidEventID {
+			http.Error(w, "after must be an event ID previously returned by this room", http.StatusBadRequest)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(logged)
+}
+
+// catchUp builds what a newly connected client should be sent before live updates: the events it missed
+// since resumeFrom (if any) followed by a snapshot of the room. The returned ID is the newest event
+// already covered by what is sent, live events up to it can be skipped.
+func (s *Server) catchUp(roomID, resumeFrom string) ([]outgoingMessage, string, error) {
+	var backlog []outgoingMessage
+	lastSent := ""
+	if resumeFrom != "" {
+		missed, err := s.bus.ReadEvents(channelString(roomID), resumeFrom)
+		if err != nil && err != storage.ErrInvalidEventID {
+			return nil, "", err
+		}
+		// an unknown ID just means the client gets the snapshot without a replay
+		for i := range missed {
+			backlog = append(backlog, outgoingMessage{
+				ID:      missed[i].ID,
+				Name:    string(missed[i].Type),
+				Message: streamMessage{Event: &missed[i]},
+			})
+			lastSent = missed[i].ID
+		}
+	}
+	snapshotID, err := s.bus.LastEventID(channelString(roomID))
+	if err != nil {
+		s.logger.Printf("failed to read last event ID for room %s: %v\n", roomID, err)
+	}
+	roomState, err := s.rooms.RoomState(roomID)
+	if err != nil {
+		return nil, "", err
+	}
+	if snapshotID != "" && !alreadySent(snapshotID, lastSent) {
+		lastSent = snapshotID
+	}
+	backlog = append(backlog, outgoingMessage{
+		ID:      lastSent,
+		Name:    "room-state",
+		Message: streamMessage{State: roomState},
+	})
+	return backlog, lastSent, nil
 }
 
 // Queue
@@ -255,74 +697,103 @@ func (s *Server) QueuesPlaylist(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Missing roomID parameter", http.StatusBadRequest)
 		return
 	}
-	if !storage.NewDocumentStore(s.documentLogger).RoomExist(roomID) {
+	if !s.rooms.RoomExist(roomID) {
 		http.Error(w, fmt.Sprintf("Room with ID [ %s ] does not exist", roomID), http.StatusNotFound)
 		return
 	}
 	s.logger.Printf("Handling playlist for roomID: %s\n", roomID)
 	switch r.Method {
 	case "POST":
+		// songs are added as the user in the room token
+		claims, ok := requireRole(w, r, internal.RoleHost, internal.RoleCoHost, internal.RoleGuest)
+		if !ok {
+			return
+		}
 		var reqBody AddSongRequest
 		err := json.NewDecoder(r.Body).Decode(&reqBody)
 		if err != nil {
 			http.Error(w, "Invalid request body", http.StatusBadRequest)
 			return
 		}
-		if reqBody.SongName == "" || reqBody.ArtistName == "" || reqBody.AlbumName == "" || reqBody.AddedBy == "" {
-			http.Error(w, "SongName, ArtistName, AlbumName and AddedBy are required", http.StatusBadRequest)
+		if reqBody.SongName == "" || reqBody.ArtistName == "" || reqBody.AlbumName == "" {
+			http.Error(w, "SongName, ArtistName and AlbumName are required", http.StatusBadRequest)
 			return
 		}
-		requestContents := fmt.Sprintf("%s-%s-%s-%s", reqBody.SongName, reqBody.ArtistName, reqBody.AlbumName, reqBody.AddedBy)
+		requestContents := fmt.Sprintf("%s-%s-%s-%s", reqBody.SongName, reqBody.ArtistName, reqBody.AlbumName, claims.Username)
 		hash := hashStrings(requestContents)
-		mq := storage.NewMessageQueue(s.cacheLogger) // Create once, reuse
-		if mq.EnsureKeyExists(hash) == nil {
+		if s.cache.EnsureKeyExists(hash) == nil {
 			http.Error(w, "You have already added this song to the queue recently, please wait a while before adding it again", http.StatusTooManyRequests)
 			return
 		}
-		s.logger.Printf("setting %s in redis with expiry of %s\n", hash, SongInteractionTimeout.String())
-		go mq.SetKeyWithExpiry(hash, "1", SameSongTimeout)
-		err = storage.NewDocumentStore(s.documentLogger).AddSongToQueue(roomID, map[string]interface{}{
-			"songID": internal.RandomHash(),
-			"stats": map[string]interface{}{
-				"songName":   reqBody.SongName,
-				"artistName": reqBody.ArtistName,
-				"albumName":  reqBody.AlbumName,
-				"addedBy":    reqBody.AddedBy,
+		songID := internal.RandomHash()
+		err = s.rooms.AddSongToQueue(roomID, storage.Song{
+			SongID: songID,
+			Stats: storage.SongStats{
+				Title:  reqBody.SongName,
+				Artist: reqBody.ArtistName,
+				Album:  reqBody.AlbumName,
 			},
-		})
+			Metadata: storage.SongMetadata{AddedBy: claims.Username},
+		}, reqBody.ExternalID)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			switch {
+			case errors.Is(err, storage.ErrAddSongCooldown):
+				http.Error(w, err.Error(), http.StatusTooManyRequests)
+			case errors.Is(err, storage.ErrTooManyPendingSongs), errors.Is(err, storage.ErrTooManyConsecutiveSongs):
+				http.Error(w, err.Error(), http.StatusForbidden)
+			case err == storage.ErrConcurrentRoomUpdate:
+				http.Error(w, err.Error(), http.StatusConflict)
+			default:
+				http.Error(w, err.Error(), http.StatusBadRequest)
+			}
 			return
 		}
+		// only remember the request once it made it into the queue, a rejected add can be retried right away
+		s.logger.Printf("setting %s in redis with expiry of %s\n", hash, SameSongTimeout.String())
+		go s.cache.SetKeyWithExpiry(hash, "1", SameSongTimeout)
 		go NewDownloadQueue().RetrieveSong(reqBody)
-		go storage.NewMessageQueue(s.cacheLogger).UpdateChannel(channelString(roomID), genericCheckUpdates)
+		s.publishEvent(roomID, events.SongAdded, claims.Username, events.SongAddedPayload{
+			SongID:    songID,
+			CatalogID: storage.CatalogID(reqBody.SongName, reqBody.ArtistName, reqBody.AlbumName, reqBody.ExternalID),
+			Title:     reqBody.SongName,
+			Artist:    reqBody.ArtistName,
+			Album:     reqBody.AlbumName,
+			AddedBy:   claims.Username,
+		})
 		w.WriteHeader(http.StatusCreated)
 	case "GET":
 		// Get current queue
-		resp, err := storage.NewDocumentStore(s.documentLogger).GetCurrentQueue(roomID)
+		resp, err := s.rooms.GetCurrentQueue(roomID)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
+		if claims, ok := claimsFromContext(r); ok {
+			storage.MarkMyVotes(resp, claims.Username)
+		}
 		json.NewEncoder(w).Encode(resp)
 	case "PUT":
-		err := jwtValidation(*r)
-		if err != nil {
-			http.Error(w, "[Invalid Token] "+err.Error(), http.StatusUnauthorized)
+		claims, ok := s.requirePermission(w, r, roomID, storage.PermissionReorder)
+		if !ok {
 			return
 		}
 		var reqBody NewOrderRequest
-		err = json.NewDecoder(r.Body).Decode(&reqBody)
+		err := json.NewDecoder(r.Body).Decode(&reqBody)
 		if err != nil {
 			http.Error(w, "Invalid request body", http.StatusBadRequest)
 			return
 		}
-		updatedQueue, err := storage.NewDocumentStore(s.documentLogger).UpdateQueue(roomID, reqBody.NewOrder)
+		updatedQueue, err := s.rooms.UpdateQueue(roomID, reqBody.NewOrder)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			switch err {
+			case storage.ErrConcurrentRoomUpdate:
+				http.Error(w, err.Error(), http.StatusConflict)
+			default:
+				http.Error(w, err.Error(), http.StatusBadRequest)
+			}
 			return
 		}
-		go storage.NewMessageQueue(s.cacheLogger).UpdateChannel(channelString(roomID), genericCheckUpdates)
+		s.publishEvent(roomID, events.QueueReordered, claims.Username, events.QueueReorderedPayload{Order: reqBody.NewOrder})
 		json.NewEncoder(w).Encode(updatedQueue)
 	default:
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -335,51 +806,69 @@ func (s *Server) Metrics(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Missing roomID parameter", http.StatusBadRequest)
 		return
 	}
-	if !storage.NewDocumentStore(s.documentLogger).RoomExist(roomID) {
+	if !s.rooms.RoomExist(roomID) {
 		http.Error(w, fmt.Sprintf("Room with ID [ %s ] does not exist", roomID), http.StatusNotFound)
 		return
 	}
 	switch r.Method {
 	case "GET":
-		resp, err := storage.NewDocumentStore(s.documentLogger).RoomMetrics(roomID)
+		resp, err := s.rooms.RoomMetrics(roomID)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 		json.NewEncoder(w).Encode(resp)
 	case "POST":
+		// votes are keyed by the token's username so a guest can't vote again under another name
+		claims, ok := requireRole(w, r, internal.RoleHost, internal.RoleCoHost, internal.RoleGuest)
+		if !ok {
+			return
+		}
 		var reqBody SongMetricRequest
 		err := json.NewDecoder(r.Body).Decode(&reqBody)
 		if err != nil {
 			http.Error(w, "Invalid request body", http.StatusBadRequest)
 			return
 		}
-		if reqBody.SongID == "" || reqBody.Action == "" || reqBody.UserID == "" {
-			http.Error(w, "SongID, Action and UserID are required", http.StatusBadRequest)
+		if reqBody.SongID == "" || reqBody.Action == "" {
+			http.Error(w, "SongID and Action are required", http.StatusBadRequest)
 			return
 		}
-		reqContents := fmt.Sprintf(("%s-%s"), reqBody.SongID, reqBody.UserID)
+		reqContents := fmt.Sprintf(("%s-%s"), reqBody.SongID, claims.Username)
 		hash := hashStrings(reqContents)
-		mq := storage.NewMessageQueue(s.cacheLogger) // Create once, reuse
-		if mq.EnsureKeyExists(hash) == nil {
+		if s.cache.EnsureKeyExists(hash) == nil {
 			http.Error(w, "You have already performed this action on this song recently, please wait a while before trying again", http.StatusTooManyRequests)
 			return
 		}
-		s.logger.Printf("setting %s in redis with expiry of %s\n", hash, SongInteractionTimeout.String())
-		go mq.SetKeyWithExpiry(hash, "1", SongInteractionTimeout)
-		err = storage.NewDocumentStore(s.documentLogger).SongOperation(roomID, reqBody.SongID, reqBody.UserID, reqBody.Action)
+		vote, newOrder, err := s.rooms.SongOperation(roomID, reqBody.SongID, claims.Username, reqBody.Action)
 		if err != nil {
-			switch err {
-			case storage.ErrInvalidSongOperation(reqBody.Action):
+			switch {
+			case errors.Is(err, storage.ErrInvalidSongOperation):
 				http.Error(w, err.Error(), http.StatusBadRequest)
 				return
+			case err == storage.ErrSongNotInQueue:
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			case err == storage.ErrConcurrentRoomUpdate:
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
 			default:
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
 		}
-		go storage.NewMessageQueue(s.cacheLogger).UpdateChannel(channelString(roomID), genericCheckUpdates)
-		w.WriteHeader(http.StatusNoContent)
+		// only a vote that went through counts toward the throttle, a rejected one can be retried right away
+		s.logger.Printf("setting %s in redis with expiry of %s\n", hash, SongInteractionTimeout.String())
+		s.cache.SetKeyWithExpiry(hash, "1", SongInteractionTimeout)
+		if vote.Changed {
+			s.publishEvent(roomID, storage.SongVoteEvent(reqBody.Action), claims.Username, events.SongVotePayload{SongID: reqBody.SongID, Action: reqBody.Action, Likes: vote.Likes, Dislikes: vote.Dislikes})
+		}
+		// in vote mode the vote can move songs around
+		if newOrder != nil {
+			s.publishEvent(roomID, events.QueueReordered, claims.Username, events.QueueReorderedPayload{Order: newOrder})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(vote)
 	}
 }
 
@@ -389,23 +878,21 @@ func (s *Server) MetricsPlaylistSend(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Missing roomID parameter", http.StatusBadRequest)
 		return
 	}
-	if !storage.NewDocumentStore(s.documentLogger).RoomExist(roomID) {
+	if !s.rooms.RoomExist(roomID) {
 		http.Error(w, fmt.Sprintf("Room with ID [ %s ] does not exist", roomID), http.StatusNotFound)
 		return
 	}
-	err := jwtValidation(*r)
-	if err != nil {
-		http.Error(w, "[Invalid Token] "+err.Error(), http.StatusUnauthorized)
+	if _, ok := s.requirePermission(w, r, roomID, ""); !ok {
 		return
 	}
 	var reqBody NotifyUserRequest
-	err = json.NewDecoder(r.Body).Decode(&reqBody)
+	err := json.NewDecoder(r.Body).Decode(&reqBody)
 	if err != nil {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
 	s.logger.Printf("Received notify request for roomID: %s with body: %+v\n", roomID, reqBody)
-	mostLiked, currentQueue, err := storage.NewDocumentStore(s.documentLogger).GetRoomsPlaylist(roomID)
+	mostLiked, currentQueue, err := s.rooms.GetRoomsPlaylist(roomID)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
@@ -425,11 +912,11 @@ func (s *Server) MetricsHistory(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Missing roomID parameter", http.StatusBadRequest)
 		return
 	}
-	if !storage.NewDocumentStore(s.documentLogger).RoomExist(roomID) {
+	if !s.rooms.RoomExist(roomID) {
 		http.Error(w, fmt.Sprintf("Room with ID [ %s ] does not exist", roomID), http.StatusNotFound)
 		return
 	}
-	resp, err := storage.NewDocumentStore(s.documentLogger).QueueHistory(roomID)
+	resp, err := s.rooms.QueueHistory(roomID)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
@@ -444,36 +931,418 @@ func (s *Server) NextSong(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Missing roomID parameter", http.StatusBadRequest)
 		return
 	}
-	if !storage.NewDocumentStore(s.documentLogger).RoomExist(roomID) {
+	if !s.rooms.RoomExist(roomID) {
 		http.Error(w, fmt.Sprintf("Room with ID [ %s ] does not exist", roomID), http.StatusNotFound)
 		return
 	}
-	err := storage.NewDocumentStore(s.documentLogger).NextSong(roomID)
+	claims, ok := s.requirePermission(w, r, roomID, storage.PermissionSkip)
+	if !ok {
+		return
+	}
+	playedSongID, nowPlayingSongID, err := s.rooms.NextSong(roomID)
 	if err != nil {
 		switch err {
 		case storage.ErrQueueIsEmpty:
 			http.Error(w, "The queue is empty, cannot move to next song", http.StatusNoContent)
 			return
+		case storage.ErrConcurrentRoomUpdate, storage.ErrRoomNotStarted:
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
 		default:
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 	}
-	go storage.NewMessageQueue(s.cacheLogger).UpdateChannel(channelString(roomID), genericCheckUpdates)
+	s.publishEvent(roomID, events.SongAdvanced, claims.Username, events.SongAdvancedPayload{PlayedSongID: playedSongID, NowPlayingSongID: nowPlayingSongID})
 	w.WriteHeader(http.StatusOK)
 }
 
+// Songs returns a song from the catalog with its stats across every session it was played in
+func (s *Server) Songs(w http.ResponseWriter, r *http.Request) {
+	catalogID := mux.Vars(r)["catalogID"]
+	if catalogID == "" {
+		http.Error(w, "Missing catalogID parameter", http.StatusBadRequest)
+		return
+	}
+	song, err := s.rooms.GetCatalogSong(catalogID)
+	if err != nil {
+		switch err {
+		case storage.ErrSongNotInCatalog:
+			http.Error(w, err.Error(), http.StatusNotFound)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(song)
+}
+
+// Sessions returns the archive of a finished session: what played, who was there and the awards
+func (s *Server) Sessions(w http.ResponseWriter, r *http.Request) {
+	sessionID := mux.Vars(r)["sessionID"]
+	if sessionID == "" {
+		http.Error(w, "Missing sessionID parameter", http.StatusBadRequest)
+		return
+	}
+	session, err := s.rooms.GetSession(sessionID)
+	if err != nil {
+		switch err {
+		case storage.ErrSessionNotFound:
+			http.Error(w, err.Error(), http.StatusNotFound)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(session)
+}
+
+// UserSessions lists the finished sessions a user hosted or joined, newest first. Only the user themselves can see them.
+func (s *Server) UserSessions(w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["username"]
+	if username == "" {
+		http.Error(w, "Missing username parameter", http.StatusBadRequest)
+		return
+	}
+	claims, ok := claimsFromContext(r)
+	if !ok {
+		http.Error(w, "[Invalid Token] a bearer token is required", http.StatusUnauthorized)
+		return
+	}
+	if claims.Username != username {
+		http.Error(w, "[Forbidden] you can only list your own sessions", http.StatusForbidden)
+		return
+	}
+	sessions, err := s.rooms.UserSessions(username)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sessions)
+}
+
+// SkipSong records the caller's vote to skip the song that is playing and advances the queue once enough of the room agrees
+func (s *Server) SkipSong(w http.ResponseWriter, r *http.Request) {
+	roomID := mux.Vars(r)["roomID"]
+	if roomID == "" {
+		http.Error(w, "Missing roomID parameter", http.StatusBadRequest)
+		return
+	}
+	claims, ok := requireRole(w, r, internal.RoleHost, internal.RoleCoHost, internal.RoleGuest)
+	if !ok {
+		return
+	}
+	vote, err := s.rooms.VoteToSkip(roomID, claims.Username)
+	if err != nil {
+		switch err {
+		case storage.ErrRoomDoesntExist:
+			http.Error(w, fmt.Sprintf("Room with ID [ %s ] does not exist", roomID), http.StatusNotFound)
+		case storage.ErrQueueIsEmpty:
+			http.Error(w, "The queue is empty, there is no song to skip", http.StatusConflict)
+		case storage.ErrAlreadyVotedToSkip, storage.ErrConcurrentRoomUpdate, storage.ErrRoomNotStarted:
+			http.Error(w, err.Error(), http.StatusConflict)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	s.publishEvent(roomID, events.SkipVoted, claims.Username, events.SkipVotedPayload{SongID: vote.SongID, Votes: vote.Votes, Needed: vote.Needed})
+	if vote.Skipped {
+		s.publishEvent(roomID, events.SongAdvanced, "", events.SongAdvancedPayload{PlayedSongID: vote.SongID, NowPlayingSongID: vote.NowPlayingSongID, Skipped: true})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(vote)
+}
+
+// RoomToken issues the caller a new token for the role they have in the room right now.
+// Co-hosts use it after being promoted and the new host after a host transfer.
+func (s *Server) RoomToken(w http.ResponseWriter, r *http.Request) {
+	roomID := mux.Vars(r)["roomID"]
+	claims, ok := requireRole(w, r, internal.RoleHost, internal.RoleCoHost, internal.RoleGuest)
+	if !ok {
+		return
+	}
+	token, role, err := s.rooms.RoomToken(roomID, claims.Username)
+	if err != nil {
+		switch err {
+		case storage.ErrRoomDoesntExist:
+			http.Error(w, fmt.Sprintf("Room with ID [ %s ] does not exist", roomID), http.StatusNotFound)
+		case storage.ErrUserNotInRoom:
+			http.Error(w, err.Error(), http.StatusForbidden)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"role":        role.Role,
+		"permissions": role.Permissions,
+		"accessToken": token,
+	})
+}
+
+// CoHosts lets the host promote a guest to co-host with a set of permissions (PUT) or demote them again (DELETE)
+func (s *Server) CoHosts(w http.ResponseWriter, r *http.Request) {
+	roomID := mux.Vars(r)["roomID"]
+	username := mux.Vars(r)["username"]
+	claims, ok := s.requirePermission(w, r, roomID, "")
+	if !ok {
+		return
+	}
+	var coHosts []storage.CoHost
+	var err error
+	switch r.Method {
+	case "PUT":
+		var reqBody CoHostRequest
+		if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		coHosts, err = s.rooms.SetCoHost(roomID, claims.Username, username, reqBody.Permissions)
+	case "DELETE":
+		coHosts, err = s.rooms.RemoveCoHost(roomID, claims.Username, username)
+	}
+	if err != nil {
+		switch err {
+		case storage.ErrRoomDoesntExist, storage.ErrUserNotInRoom, storage.ErrNotCoHost:
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case storage.ErrNotRoomHost:
+			http.Error(w, err.Error(), http.StatusForbidden)
+		case storage.ErrConcurrentRoomUpdate:
+			http.Error(w, err.Error(), http.StatusConflict)
+		default:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+		return
+	}
+	payload := events.CoHostsChangedPayload{CoHosts: []events.CoHostPayload{}}
+	for _, coHost := range coHosts {
+		payload.CoHosts = append(payload.CoHosts, events.CoHostPayload(coHost))
+	}
+	s.publishEvent(roomID, events.CoHostsChanged, claims.Username, payload)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(coHosts)
+}
+
+// TransferHost hands the room to another user in it. The previous host gets a guest token back,
+// the new host picks up the host token from RoomToken.
+func (s *Server) TransferHost(w http.ResponseWriter, r *http.Request) {
+	roomID := mux.Vars(r)["roomID"]
+	claims, ok := s.requirePermission(w, r, roomID, "")
+	if !ok {
+		return
+	}
+	var reqBody TransferHostRequest
+	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil || reqBody.Username == "" {
+		http.Error(w, "username of the new host is required", http.StatusBadRequest)
+		return
+	}
+	transfer, err := s.rooms.TransferHost(roomID, claims.Username, reqBody.Username)
+	if err != nil {
+		switch err {
+		case storage.ErrRoomDoesntExist, storage.ErrUserNotInRoom:
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case storage.ErrNotRoomHost:
+			http.Error(w, err.Error(), http.StatusForbidden)
+		case storage.ErrConcurrentRoomUpdate:
+			http.Error(w, err.Error(), http.StatusConflict)
+		default:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+		return
+	}
+	s.publishEvent(roomID, events.HostChanged, claims.Username, events.HostChangedPayload{HostID: transfer.HostID, PreviousHostID: transfer.PreviousHostID})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(transfer)
+}
+
+// KickUser removes a user and their pending songs from the room, optionally banning them.
+// Tokens issued to them before the kick stop working and their client is told to disconnect.
+func (s *Server) KickUser(w http.ResponseWriter, r *http.Request) {
+	roomID := mux.Vars(r)["roomID"]
+	claims, ok := s.requirePermission(w, r, roomID, storage.PermissionKick)
+	if !ok {
+		return
+	}
+	var reqBody KickUserRequest
+	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil || reqBody.Username == "" {
+		http.Error(w, "username of the user to kick is required", http.StatusBadRequest)
+		return
+	}
+	kick, err := s.rooms.KickUser(roomID, claims.Username, reqBody.Username, reqBody.Ban, reqBody.ResetPassword)
+	if err != nil {
+		switch err {
+		case storage.ErrRoomDoesntExist, storage.ErrUserNotInRoom:
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case storage.ErrPermissionDenied, storage.ErrNotRoomHost, storage.ErrCantKickHost:
+			http.Error(w, "[Forbidden] "+err.Error(), http.StatusForbidden)
+		case storage.ErrConcurrentRoomUpdate:
+			http.Error(w, err.Error(), http.StatusConflict)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	s.publishEvent(roomID, events.UserKicked, claims.Username, events.UserKickedPayload{
+		Username:       kick.Username,
+		Banned:         kick.Banned,
+		RemovedSongIDs: kick.RemovedSongIDs,
+	})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(kick)
+}
+
+// LeaveRoom takes the caller out of the room, freeing their spot. The host has to hand the room over or end it instead.
+func (s *Server) LeaveRoom(w http.ResponseWriter, r *http.Request) {
+	roomID := mux.Vars(r)["roomID"]
+	claims, ok := requireRole(w, r, internal.RoleCoHost, internal.RoleGuest, internal.RoleHost)
+	if !ok {
+		return
+	}
+	err := s.rooms.LeaveRoom(roomID, claims.Username)
+	if err != nil {
+		switch err {
+		case storage.ErrRoomDoesntExist:
+			http.Error(w, fmt.Sprintf("Room with ID [ %s ] does not exist", roomID), http.StatusNotFound)
+		case storage.ErrUserNotInRoom:
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case storage.ErrHostCantLeave:
+			http.Error(w, err.Error(), http.StatusConflict)
+		case storage.ErrConcurrentRoomUpdate:
+			http.Error(w, err.Error(), http.StatusConflict)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	s.publishEvent(roomID, events.UserLeft, claims.Username, events.UserLeftPayload{Username: claims.Username})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Heartbeat keeps the caller counted as active in the room, clients without an open state stream
+// should call it more often than storage.PresenceTimeout
+func (s *Server) Heartbeat(w http.ResponseWriter, r *http.Request) {
+	roomID := mux.Vars(r)["roomID"]
+	claims, ok := requireRole(w, r, internal.RoleHost, internal.RoleCoHost, internal.RoleGuest)
+	if !ok {
+		return
+	}
+	err := s.rooms.Heartbeat(roomID, claims.Username)
+	if err != nil {
+		switch err {
+		case storage.ErrRoomDoesntExist:
+			http.Error(w, fmt.Sprintf("Room with ID [ %s ] does not exist", roomID), http.StatusNotFound)
+		case storage.ErrUserNotInRoom:
+			http.Error(w, err.Error(), http.StatusForbidden)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
 // Handlers
 
 // Middleware
-func jwtValidation(r http.Request) error {
-	token := r.Header.Get("Authorization")
+type contextKey string
+
+const claimsContextKey contextKey = "claims"
+
+// bearerToken is the token sent in the Authorization header. Browsers can't set headers on websockets
+// or EventSource, so the state streams may pass it as ?accessToken= instead.
+func bearerToken(r *http.Request) string {
+	if token := r.URL.Query().Get("accessToken"); token != "" && r.Header.Get("Authorization") == "" {
+		return "Bearer " + token
+	}
+	return r.Header.Get("Authorization")
+}
+
+func jwtValidation(r http.Request) (*internal.Claims, error) {
+	token := bearerToken(&r)
 	if !strings.HasPrefix(token, "Bearer ") {
-		return fmt.Errorf("invalid token format")
+		return nil, fmt.Errorf("invalid token format")
 	}
 	token = strings.TrimPrefix(token, "Bearer ")
-	err := internal.NewJWTHandler().VerifyToken(token)
-	return err
+	return internal.NewJWTHandler().VerifyToken(token)
+}
+
+// Authenticate verifies the bearer token when one is sent and puts its claims on the request context.
+// Revoked and refresh tokens are turned away. Room tokens are scoped to a single room, so a token used
+// on a route for another {roomID} is rejected.
+func (s *Server) Authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if bearerToken(r) == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		claims, err := jwtValidation(*r)
+		if err == internal.ErrRevocationFailed {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		if err != nil {
+			http.Error(w, "[Invalid Token] "+err.Error(), http.StatusUnauthorized)
+			return
+		}
+		// user tokens aren't tied to a room, requireRole keeps them off the room endpoints
+		if roomID := mux.Vars(r)["roomID"]; roomID != "" && claims.Role != internal.RoleUser && claims.RoomID != roomID {
+			http.Error(w, "[Forbidden] this token was not issued for this room", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), claimsContextKey, claims)))
+	})
+}
+
+func claimsFromContext(r *http.Request) (*internal.Claims, bool) {
+	claims, ok := r.Context().Value(claimsContextKey).(*internal.Claims)
+	return claims, ok
+}
+
+// requireRole returns the caller's claims if their token holds one of roles.
+// Otherwise it writes a 401 (no token) or 403 (wrong role) and returns false.
+func requireRole(w http.ResponseWriter, r *http.Request, roles ...string) (*internal.Claims, bool) {
+	claims, ok := claimsFromContext(r)
+	if !ok {
+		http.Error(w, "[Invalid Token] a bearer token is required", http.StatusUnauthorized)
+		return nil, false
+	}
+	if !slices.Contains(roles, claims.Role) {
+		http.Error(w, fmt.Sprintf("[Forbidden] this action requires one of the roles %v", roles), http.StatusForbidden)
+		return nil, false
+	}
+	return claims, true
+}
+
+// requirePermission is requireRole for room actions the host can hand to co-hosts, an empty permission
+// means the host alone. The room is asked rather than the token so promotions, demotions and host
+// transfers apply right away.
+func (s *Server) requirePermission(w http.ResponseWriter, r *http.Request, roomID, permission string) (*internal.Claims, bool) {
+	claims, ok := requireRole(w, r, internal.RoleHost, internal.RoleCoHost, internal.RoleGuest)
+	if !ok {
+		return nil, false
+	}
+	role, err := s.rooms.RoomRole(roomID, claims.Username)
+	if err != nil {
+		switch err {
+		case storage.ErrRoomDoesntExist:
+			http.Error(w, fmt.Sprintf("Room with ID [ %s ] does not exist", roomID), http.StatusNotFound)
+		case storage.ErrUserNotInRoom:
+			http.Error(w, "[Forbidden] "+err.Error(), http.StatusForbidden)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return nil, false
+	}
+	if role.Role != internal.RoleHost && (permission == "" || !role.Can(permission)) {
+		http.Error(w, "[Forbidden] "+storage.ErrPermissionDenied.Error(), http.StatusForbidden)
+		return nil, false
+	}
+	return claims, true
 }
 
 func Cors(next http.Handler) http.Handler {
@@ -491,7 +1360,7 @@ func Cors(next http.Handler) http.Handler {
 func (s *Server) SimpleLogger(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		go func() {
-			storage.NewMessageQueue(s.cacheLogger).Incr(fmt.Sprintf("%s:%s", r.Method, r.URL.Path)) // keep track of last request time for monitoring purposes
+			s.cache.Incr(fmt.Sprintf("%s:%s", r.Method, r.URL.Path)) // keep track of last request time for monitoring purposes
 		}()
 		next.ServeHTTP(w, r)
 	})
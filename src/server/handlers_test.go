@@ -0,0 +1,332 @@
+package server
+
+import (
+	"BeatBus/events"
+	"BeatBus/internal"
+	"BeatBus/storage"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	os.Setenv("PORT", "0")
+	os.Setenv("JWT_SECRET", "test-secret")
+	os.Setenv("OUTPUT_FILE_NAME", os.DevNull)
+	os.Exit(m.Run())
+}
+
+// testServer runs the handlers on the in-memory stores, the same way --memory does
+type testServer struct {
+	t       *testing.T
+	handler http.Handler
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+	return &testServer{t: t, handler: NewMemoryServer().handler()}
+}
+
+// do sends the request with token as the bearer token (if any) and decodes a JSON response into out (if given)
+func (ts *testServer) do(method, path, token string, body, out interface{}) int {
+	ts.t.Helper()
+	var reader bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&reader).Encode(body); err != nil {
+			ts.t.Fatalf("encoding body for %s %s: %v", method, path, err)
+		}
+	}
+	req := httptest.NewRequest(method, path, &reader)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	ts.handler.ServeHTTP(rec, req)
+	if out != nil && rec.Code < 300 {
+		if err := json.Unmarshal(rec.Body.Bytes(), out); err != nil {
+			ts.t.Fatalf("decoding response of %s %s: %v (%s)", method, path, err, rec.Body.String())
+		}
+	}
+	return rec.Code
+}
+
+func (ts *testServer) expect(want int, method, path, token string, body, out interface{}) {
+	ts.t.Helper()
+	if got := ts.do(method, path, token, body, out); got != want {
+		ts.t.Fatalf("%s %s returned %d, want %d", method, path, got, want)
+	}
+}
+
+// login signs username up and returns their user token
+func (ts *testServer) login(username string) string {
+	ts.t.Helper()
+	creds := AuthRequest{Username: username, Password: "password"}
+	ts.expect(http.StatusCreated, "POST", "/signUp", "", creds, nil)
+	var resp LogInResponse
+	ts.expect(http.StatusOK, "POST", "/login", "", creds, &resp)
+	return resp.AccessToken.Token
+}
+
+// createRoom makes username host of a new room and returns it with the host token
+func (ts *testServer) createRoom(username string, req CreateRoomRequest) (storage.RoomProps, string) {
+	ts.t.Helper()
+	var created storage.CreatedRoom
+	ts.expect(http.StatusOK, "POST", "/rooms", ts.login(username), req, &created)
+	return created.RoomProps, created.AccessToken.Token
+}
+
+// join lets username into the room with its password and returns their guest token
+func (ts *testServer) join(room storage.RoomProps, username string) string {
+	ts.t.Helper()
+	var resp struct {
+		AccessToken JWT_AccessToken `json:"accessToken"`
+	}
+	ts.expect(http.StatusOK, "GET", joinPath(room.RoomID, room.RoomPassword, username), "", nil, &resp)
+	return resp.AccessToken.Token
+}
+
+func joinPath(roomID, password, username string) string {
+	return "/rooms/" + roomID + "?" + url.Values{"roomPassword": {password}, "username": {username}}.Encode()
+}
+
+func (ts *testServer) queue(roomID string) []storage.QueueEntry {
+	ts.t.Helper()
+	var queue []storage.QueueEntry
+	ts.expect(http.StatusOK, "GET", "/queues/"+roomID+"/playlist", "", nil, &queue)
+	return queue
+}
+
+func song(name string) AddSongRequest {
+	return AddSongRequest{SongName: name, ArtistName: "artist", AlbumName: "album"}
+}
+
+func TestCreateAndJoinRoom(t *testing.T) {
+	ts := newTestServer(t)
+	ts.expect(http.StatusUnauthorized, "POST", "/rooms", "", CreateRoomRequest{RoomName: "party", LifeTime: 60, MaxUsers: 2}, nil)
+	room, hostToken := ts.createRoom("host", CreateRoomRequest{RoomName: "party", LifeTime: 60, MaxUsers: 2})
+	if room.RoomID == "" || room.RoomPassword == "" || hostToken == "" {
+		t.Fatalf("created room is missing its ID, password or host token: %+v", room)
+	}
+	if room.HostID != "host" {
+		t.Errorf("hostID is %q, want host", room.HostID)
+	}
+
+	ts.expect(http.StatusUnauthorized, "GET", joinPath(room.RoomID, "wrong", "guest"), "", nil, nil)
+	ts.expect(http.StatusNotFound, "GET", joinPath("no-such-room", room.RoomPassword, "guest"), "", nil, nil)
+	if ts.join(room, "guest") == "" {
+		t.Fatal("joining returned no token")
+	}
+	// without its token the name is taken
+	ts.expect(http.StatusConflict, "GET", joinPath(room.RoomID, room.RoomPassword, "guest"), "", nil, nil)
+	// the host and the guest fill the room
+	ts.expect(http.StatusForbidden, "GET", joinPath(room.RoomID, room.RoomPassword, "late"), "", nil, nil)
+}
+
+func TestAddSongAndVote(t *testing.T) {
+	ts := newTestServer(t)
+	room, hostToken := ts.createRoom("host", CreateRoomRequest{RoomName: "party", LifeTime: 60, MaxUsers: 10})
+	guestToken := ts.join(room, "guest")
+	playlist := "/queues/" + room.RoomID + "/playlist"
+
+	ts.expect(http.StatusUnauthorized, "POST", playlist, "", song("first"), nil)
+	ts.expect(http.StatusCreated, "POST", playlist, hostToken, song("first"), nil)
+	ts.expect(http.StatusCreated, "POST", playlist, guestToken, song("second"), nil)
+	ts.expect(http.StatusBadRequest, "POST", playlist, guestToken, AddSongRequest{SongName: "incomplete"}, nil)
+
+	queue := ts.queue(room.RoomID)
+	if len(queue) != 2 {
+		t.Fatalf("queue has %d songs, want 2", len(queue))
+	}
+	if queue[1].Song.Metadata.AddedBy != "guest" {
+		t.Errorf("second song was added by %q, want the guest from the token", queue[1].Song.Metadata.AddedBy)
+	}
+
+	metrics := "/metrics/" + room.RoomID
+	songID := queue[1].Song.SongID
+	var vote storage.SongVote
+	ts.expect(http.StatusOK, "POST", metrics, hostToken, SongMetricRequest{SongID: songID, Action: "like"}, &vote)
+	if vote.Likes != 1 || vote.MyVote != "like" {
+		t.Errorf("after a like the vote is %+v, want one like by the caller", vote)
+	}
+	ts.expect(http.StatusBadRequest, "POST", metrics, guestToken, SongMetricRequest{SongID: songID, Action: "love"}, nil)
+	ts.expect(http.StatusNotFound, "POST", metrics, guestToken, SongMetricRequest{SongID: "no-such-song", Action: "like"}, nil)
+	// rejected votes don't count toward the throttle, the first vote that goes through does
+	ts.expect(http.StatusOK, "POST", metrics, guestToken, SongMetricRequest{SongID: songID, Action: "like"}, nil)
+	ts.expect(http.StatusTooManyRequests, "POST", metrics, guestToken, SongMetricRequest{SongID: songID, Action: "unlike"}, nil)
+}
+
+func TestSkipVote(t *testing.T) {
+	ts := newTestServer(t)
+	room, hostToken := ts.createRoom("host", CreateRoomRequest{RoomName: "party", LifeTime: 60, MaxUsers: 10})
+	guestToken := ts.join(room, "guest")
+	ts.join(room, "other")
+	skip := "/queues/" + room.RoomID + "/skip"
+
+	ts.expect(http.StatusConflict, "POST", skip, guestToken, nil, nil)
+	ts.expect(http.StatusCreated, "POST", "/queues/"+room.RoomID+"/playlist", hostToken, song("first"), nil)
+	ts.expect(http.StatusCreated, "POST", "/queues/"+room.RoomID+"/playlist", hostToken, song("second"), nil)
+	queue := ts.queue(room.RoomID)
+
+	// half of the three people in the room have to vote
+	var vote storage.SkipVote
+	ts.expect(http.StatusOK, "POST", skip, guestToken, nil, &vote)
+	if vote.Skipped || vote.Votes != 1 || vote.Needed != 2 {
+		t.Fatalf("first vote is %+v, want 1 of 2 votes and no skip", vote)
+	}
+	ts.expect(http.StatusConflict, "POST", skip, guestToken, nil, nil)
+	ts.expect(http.StatusOK, "POST", skip, hostToken, nil, &vote)
+	if !vote.Skipped || vote.NowPlayingSongID != queue[1].Song.SongID {
+		t.Fatalf("second vote is %+v, want the first song skipped", vote)
+	}
+	if remaining := ts.queue(room.RoomID); len(remaining) != 1 {
+		t.Errorf("queue has %d songs after the skip, want 1", len(remaining))
+	}
+}
+
+// the same refresh token sent twice at once must give out exactly one new token pair
+func TestRefreshTokenIsUsedOnce(t *testing.T) {
+	ts := newTestServer(t)
+	creds := AuthRequest{Username: "user", Password: "password"}
+	ts.expect(http.StatusCreated, "POST", "/signUp", "", creds, nil)
+	var resp LogInResponse
+	ts.expect(http.StatusOK, "POST", "/login", "", creds, &resp)
+	refresh := RefreshTokenRequest{RefreshToken: resp.AccessToken.RefreshToken}
+
+	const attempts = 10
+	codes := make(chan int, attempts)
+	var wg sync.WaitGroup
+	for range attempts {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes <- ts.do("POST", "/token/refresh", "", refresh, nil)
+		}()
+	}
+	wg.Wait()
+	close(codes)
+	counts := map[int]int{}
+	for code := range codes {
+		counts[code]++
+	}
+	if counts[http.StatusOK] != 1 || counts[http.StatusUnauthorized] != attempts-1 {
+		t.Fatalf("refresh returned %v, want one 200 and %d 401s", counts, attempts-1)
+	}
+	ts.expect(http.StatusUnauthorized, "POST", "/token/refresh", "", refresh, nil)
+}
+
+// logged in users who join a room they're already in get a token for the role they have there
+func TestRejoinKeepsRole(t *testing.T) {
+	ts := newTestServer(t)
+	hostUserToken := ts.login("host")
+	var created storage.CreatedRoom
+	ts.expect(http.StatusOK, "POST", "/rooms", hostUserToken, CreateRoomRequest{RoomName: "party", LifeTime: 60, MaxUsers: 10}, &created)
+	room, hostToken := created.RoomProps, created.AccessToken.Token
+	guestUserToken := ts.login("guest")
+	ts.expect(http.StatusOK, "GET", joinPath(room.RoomID, room.RoomPassword, ""), guestUserToken, nil, nil)
+	ts.expect(http.StatusOK, "PUT", "/rooms/"+room.RoomID+"/cohosts/guest", hostToken, CoHostRequest{Permissions: []string{storage.PermissionSkip}}, nil)
+
+	for _, rejoin := range []struct{ username, userToken, want string }{
+		{"host", hostUserToken, internal.RoleHost},
+		{"guest", guestUserToken, internal.RoleCoHost},
+	} {
+		username, want := rejoin.username, rejoin.want
+		var resp struct {
+			Role        string          `json:"role"`
+			AccessToken JWT_AccessToken `json:"accessToken"`
+		}
+		ts.expect(http.StatusOK, "GET", joinPath(room.RoomID, room.RoomPassword, ""), rejoin.userToken, nil, &resp)
+		if resp.Role != want {
+			t.Errorf("%s rejoined as %q, want %q", username, resp.Role, want)
+		}
+		claims, err := internal.NewJWTHandler().VerifyToken(resp.AccessToken.Token)
+		if err != nil {
+			t.Fatalf("token from rejoining: %v", err)
+		}
+		if claims.Role != want {
+			t.Errorf("%s's rejoin token has role %q, want %q", username, claims.Role, want)
+		}
+	}
+}
+
+func TestLeaveRoomRevokesTokens(t *testing.T) {
+	ts := newTestServer(t)
+	room, hostToken := ts.createRoom("host", CreateRoomRequest{RoomName: "party", LifeTime: 60, MaxUsers: 10})
+	guestToken := ts.join(room, "guest")
+	ts.expect(http.StatusConflict, "POST", "/rooms/"+room.RoomID+"/leave", hostToken, nil, nil)
+	ts.expect(http.StatusNoContent, "POST", "/rooms/"+room.RoomID+"/leave", guestToken, nil, nil)
+
+	ts.expect(http.StatusUnauthorized, "POST", "/queues/"+room.RoomID+"/playlist", guestToken, song("after leaving"), nil)
+	ts.expect(http.StatusUnauthorized, "POST", "/queues/"+room.RoomID+"/skip", guestToken, nil, nil)
+	// joining again works with the new token
+	rejoined := ts.join(room, "guest")
+	ts.expect(http.StatusCreated, "POST", "/queues/"+room.RoomID+"/playlist", rejoined, song("back again"), nil)
+}
+
+func TestDeleteRoom(t *testing.T) {
+	ts := newTestServer(t)
+	room, hostToken := ts.createRoom("host", CreateRoomRequest{RoomName: "party", LifeTime: 60, MaxUsers: 10})
+	guestToken := ts.join(room, "guest")
+	ts.expect(http.StatusCreated, "POST", "/queues/"+room.RoomID+"/playlist", guestToken, song("first"), nil)
+	ts.expect(http.StatusOK, "POST", "/queues/"+room.RoomID+"/nextSong", hostToken, nil, nil)
+
+	ts.expect(http.StatusForbidden, "DELETE", "/rooms", guestToken, nil, nil)
+	var summary storage.SessionSummary
+	ts.expect(http.StatusOK, "DELETE", "/rooms", hostToken, nil, &summary)
+
+	ts.expect(http.StatusNotFound, "GET", "/queues/"+room.RoomID+"/playlist", "", nil, nil)
+	// ending the session revokes every token issued for the room
+	ts.expect(http.StatusUnauthorized, "POST", "/queues/"+room.RoomID+"/skip", guestToken, nil, nil)
+	ts.expect(http.StatusUnauthorized, "DELETE", "/rooms", hostToken, nil, nil)
+	// the host can start another room afterwards
+	var created storage.CreatedRoom
+	var login LogInResponse
+	ts.expect(http.StatusOK, "POST", "/login", "", AuthRequest{Username: "host", Password: "password"}, &login)
+	ts.expect(http.StatusOK, "POST", "/rooms", login.AccessToken.Token, CreateRoomRequest{RoomName: "again", LifeTime: 60, MaxUsers: 10}, &created)
+	// nothing played in the new room, the host can still end it
+	ts.expect(http.StatusOK, "DELETE", "/rooms", created.AccessToken.Token, nil, &summary)
+	ts.expect(http.StatusNotFound, "GET", "/queues/"+created.RoomProps.RoomID+"/playlist", "", nil, nil)
+}
+
+func TestKickClosesEventStream(t *testing.T) {
+	ts := newTestServer(t)
+	room, hostToken := ts.createRoom("host", CreateRoomRequest{RoomName: "party", LifeTime: 60, MaxUsers: 10})
+	guestToken := ts.join(room, "guest")
+	live := httptest.NewServer(ts.handler)
+	defer live.Close()
+
+	resp, err := http.Get(live.URL + "/rooms/" + room.RoomID + "/events?accessToken=" + guestToken)
+	if err != nil {
+		t.Fatalf("opening the event stream: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("event stream returned %d", resp.StatusCode)
+	}
+	stream := bufio.NewScanner(resp.Body)
+	waitFor := func(event string) {
+		t.Helper()
+		for stream.Scan() {
+			if stream.Text() == "event: "+event {
+				return
+			}
+		}
+		t.Fatalf("stream ended before %s was sent", event)
+	}
+	waitFor("room-state")
+
+	ts.expect(http.StatusOK, "POST", "/rooms/"+room.RoomID+"/kick", hostToken, KickUserRequest{Username: "guest"}, nil)
+	waitFor(string(events.UserKicked))
+	waitFor("access-revoked")
+	for stream.Scan() {
+		if strings.HasPrefix(stream.Text(), "event: ") {
+			t.Errorf("the kicked user's stream went on with %q", stream.Text())
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package server
+
+import (
+	"BeatBus/internal"
+	"BeatBus/storage"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// QR codes are square, size is the side in pixels
+const (
+	defaultQRSize = 256
+	minQRSize     = 128
+	maxQRSize     = 1024
+)
+
+// InviteResponse is the room's invite with the link people open to join
+type InviteResponse struct {
+	storage.Invite
+	URL string `json:"url"`
+}
+
+// publicURL is where clients reach this server. PUBLIC_URL wins, behind a proxy the request's host may be an internal one.
+func publicURL(r *http.Request) string {
+	if publicURL := internal.GetConfig().PublicURL; publicURL != "" {
+		return strings.TrimSuffix(publicURL, "/")
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if forwarded := r.Header.Get("X-Forwarded-Proto"); forwarded != "" {
+		scheme = forwarded
+	}
+	return scheme + "://" + r.Host
+}
+
+// inviteURL is the join endpoint with the invite token in place of the room password
+func inviteURL(r *http.Request, invite storage.Invite) string {
+	return fmt.Sprintf("%s/rooms/%s?invite=%s", publicURL(r), url.PathEscape(invite.RoomID), url.QueryEscape(invite.Token))
+}
+
+// Invite lets the host make a new invite link (POST), which cuts off the old one, or look up the current one (GET)
+func (s *Server) Invite(w http.ResponseWriter, r *http.Request) {
+	roomID := mux.Vars(r)["roomID"]
+	claims, ok := s.requirePermission(w, r, roomID, "")
+	if !ok {
+		return
+	}
+	var invite storage.Invite
+	var err error
+	switch r.Method {
+	case "POST":
+		var req CreateInviteRequest
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "Invalid request body", http.StatusBadRequest)
+				return
+			}
+		}
+		if req.ExpiresInMinutes < 0 {
+			http.Error(w, "expiresInMinutes can't be negative", http.StatusBadRequest)
+			return
+		}
+		invite, err = s.rooms.CreateInvite(roomID, claims.Username, time.Duration(req.ExpiresInMinutes)*time.Minute, req.MaxUses)
+	case "GET":
+		invite, err = s.rooms.CurrentInvite(roomID, claims.Username)
+	}
+	if err != nil {
+		writeInviteError(w, roomID, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(InviteResponse{Invite: invite, URL: inviteURL(r, invite)})
+}
+
+// InviteQR returns the current invite link as a QR code, ?format=png (default) or svg and ?size= in pixels
+func (s *Server) InviteQR(w http.ResponseWriter, r *http.Request) {
+	roomID := mux.Vars(r)["roomID"]
+	claims, ok := s.requirePermission(w, r, roomID, "")
+	if !ok {
+		return
+	}
+	size := defaultQRSize
+	if raw := r.URL.Query().Get("size"); raw != "" {
+		parsed, err := strconv.Atoi(raw)
+		if err != nil {
+			http.Error(w, "size must be a number of pixels", http.StatusBadRequest)
+			return
+		}
+		size = min(max(parsed, minQRSize), maxQRSize)
+	}
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "png" && format != "svg" {
+		http.Error(w, "format must be png or svg", http.StatusBadRequest)
+		return
+	}
+	invite, err := s.rooms.CurrentInvite(roomID, claims.Username)
+	if err != nil {
+		writeInviteError(w, roomID, err)
+		return
+	}
+	code, err := qrcode.New(inviteURL(r, invite), qrcode.Medium)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// the code changes whenever the host rotates the invite
+	w.Header().Set("Cache-Control", "no-store")
+	if format == "svg" {
+		w.Header().Set("Content-Type", "image/svg+xml")
+		w.Write([]byte(qrSVG(code.Bitmap(), size)))
+		return
+	}
+	png, err := code.PNG(size)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Write(png)
+}
+
+// qrSVG draws the code's modules as one path, the viewBox is in modules so the image scales cleanly to size
+func qrSVG(bitmap [][]bool, size int) string {
+	var path strings.Builder
+	for y, row := range bitmap {
+		for x, dark := range row {
+			if dark {
+				fmt.Fprintf(&path, "M%d %dh1v1h-1z", x, y)
+			}
+		}
+	}
+	return fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`+
+		`<rect width="100%%" height="100%%" fill="#fff"/><path fill="#000" d="%s"/></svg>`,
+		size, size, len(bitmap), len(bitmap), path.String())
+}
+
+func writeInviteError(w http.ResponseWriter, roomID string, err error) {
+	switch err {
+	case storage.ErrRoomDoesntExist:
+		http.Error(w, fmt.Sprintf("Room with ID [ %s ] does not exist", roomID), http.StatusNotFound)
+	case storage.ErrNotRoomHost:
+		http.Error(w, "[Forbidden] "+err.Error(), http.StatusForbidden)
+	case storage.ErrNoInvite:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case storage.ErrInvalidInviteUse:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case storage.ErrConcurrentRoomUpdate:
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -1,6 +1,8 @@
 package server
 
 import (
+	"BeatBus/internal"
+	"BeatBus/storage"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -19,44 +21,47 @@ type AuthRequest struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
 }
-type CreateRoomRequest struct {
-	HostUserName string `json:"hostUsername"`
-	RoomName     string `json:"roomName"`
-	LifeTime     int    `json:"lifetime"` // in minutes
-	MaxUsers     int    `json:"maxUsers"`
-	IsPublic     bool   `json:"isPublic"`
-}
-type CreateRoomResponse struct {
-	Properties  RoomProperties  `json:"roomProperties"`
-	TimeStamp   int64           `json:"timeStamp"`
+
+// LogInResponse carries the user token, send it as the bearer token to create and join rooms
+type LogInResponse struct {
+	Username    string          `json:"username"`
 	AccessToken JWT_AccessToken `json:"accessToken"`
 }
-type DeleteRoomRequest struct {
-	HostUsername string `json:"hostUsername"`
-	RoomID       string `json:"roomID"`
-	AccessToken  string `json:"accessToken"`
+
+// CreateRoomRequest has no host, the host is whoever the token belongs to
+type CreateRoomRequest struct {
+	RoomName string                `json:"roomName"`
+	LifeTime int                   `json:"lifetime"` // in minutes, optional when updating a room
+	MaxUsers int                   `json:"maxUsers"`
+	IsPublic bool                  `json:"isPublic"`
+	Rules    storage.RoomRules     `json:"rules"`
+	Ordering storage.QueueOrdering `json:"ordering"`
+	StartsAt int64                 `json:"startsAt,omitempty"` // unix seconds, only when creating a scheduled room
 }
 
-type RoomProperties struct {
-	RoomID       string `json:"roomID"`
-	RoomPassword string `json:"roomPassword"`
-	HostID       string `json:"hostID"`
-	RoomName     string `json:"roomName"`
-	MaxUsers     int    `json:"maxUsers"`
-	IsPublic     bool   `json:"isPublic"`
+// CreateInviteRequest replaces the room's invite link, both fields are optional
+type CreateInviteRequest struct {
+	ExpiresInMinutes int   `json:"expiresInMinutes"` // 0 means until the room ends
+	MaxUses          int64 `json:"maxUses"`          // 0 means no limit
 }
 type JWT_AccessToken struct {
-	Token     string `json:"token"`
-	ExpiresIn int64  `json:"expiresIn"`
+	Token            string `json:"token"`
+	ExpiresIn        int64  `json:"expiresIn"`
+	RefreshToken     string `json:"refreshToken"`
+	RefreshExpiresIn int64  `json:"refreshExpiresIn"`
+}
+type RefreshTokenRequest struct {
+	RefreshToken string `json:"refreshToken"`
 }
 type AddSongRequest struct {
 	SongName   string `json:"songName"`
 	ArtistName string `json:"artistName"`
 	AlbumName  string `json:"albumName"`
-	AddedBy    string `json:"addedBy"`
+	ExternalID string `json:"externalId,omitempty"` // optional streaming service id, used to match the song across rooms
 }
+
+// SongMetricRequest is cast as the username in the room token
 type SongMetricRequest struct {
-	UserID string `json:"userID"`
 	SongID string `json:"songID"`
 	Action string `json:"action"` // [like, unlike,dislike, undislike, skip, play]
 }
@@ -65,6 +70,20 @@ type NewOrderRequest struct {
 	NewOrder []string `json:"newOrder"`
 }
 
+type CoHostRequest struct {
+	Permissions []string `json:"permissions"`
+}
+
+type TransferHostRequest struct {
+	Username string `json:"username"`
+}
+
+type KickUserRequest struct {
+	Username      string `json:"username"`
+	Ban           bool   `json:"ban"`           // keep them out for the rest of the session
+	ResetPassword bool   `json:"resetPassword"` // host only, hands out a new room password
+}
+
 type txtBeltResponse struct {
 	Success        bool   `json:"success"`
 	TextId         string `json:"textId"`
@@ -75,7 +94,7 @@ type NotifyUserRequest struct {
 	UserIds []UserNotify `json:"userIds"`
 }
 
-func (nwr *NotifyUserRequest) songDataToString(songData []interface{}) string {
+func (nwr *NotifyUserRequest) songDataToString(songData []storage.QueueEntry) string {
 	// convert songData to a string representation
 	fmt.Println("inside songDataToString function", 3)
 	var sb strings.Builder
@@ -83,24 +102,16 @@ func (nwr *NotifyUserRequest) songDataToString(songData []interface{}) string {
 		if i > 0 {
 			sb.WriteString(", ") // separator between songs
 		}
-
-		// Extract song info from the nested structure
-		songMap := songItem.(primitive.M)
-		song := songMap["song"].(primitive.M)
-		stats := song["stats"].(primitive.M)
-
-		title := stats["title"].(string)
-		artist := stats["artist"].(string)
-		album := stats["album"].(string)
+		stats := songItem.Song.Stats
 
 		// Format as "title-artist-album"
-		sb.WriteString(fmt.Sprintf("\n[song %d] %s-%s-%s", i+1, title, artist, album))
+		sb.WriteString(fmt.Sprintf("\n[song %d] %s-%s-%s", i+1, stats.Title, stats.Artist, stats.Album))
 	}
 	return sb.String()
 }
 
 // return whether the email was sent successfully or not
-func (nwr *NotifyUserRequest) sendEmail(userID, email string, songData []interface{}) (bool, string) {
+func (nwr *NotifyUserRequest) sendEmail(userID, email string, songData []storage.QueueEntry) (bool, string) {
 	fmt.Println("inside sendEmail function", 2)
 	msg := nwr.songDataToString(songData)
 	fmt.Println("out of songDataToString function, msg:", msg)
@@ -112,12 +123,17 @@ func (nwr *NotifyUserRequest) sendEmail(userID, email string, songData []interfa
 }
 
 // return whether the sms was sent successfully or not
-func (nwr *NotifyUserRequest) sendSMS(userID, phoneNumber string, songData []interface{}) (bool, string) {
+func (nwr *NotifyUserRequest) sendSMS(userID, phoneNumber string, songData []storage.QueueEntry) (bool, string) {
 	msg := nwr.songDataToString(songData)
 	fmt.Println("out of songDataToString function, msg:", msg)
 	fmt.Println("Sending SMS to:", phoneNumber)
 	// Implement actual SMS sending logic here
 	// For now, we assume it's always successful
+	cfg := internal.GetConfig()
+	if cfg.TxtBeltAPIKey == "" {
+		fmt.Println("TXT_BELT_API_KEY is not set, not sending SMS")
+		return false, ""
+	}
 	values := url.Values{
 		"phone":   {phoneNumber},
 		"message": {msg},
@@ -155,7 +171,7 @@ type FailNotification struct {
 	Reason string `json:"reason"`
 }
 
-func (nwr *NotifyUserRequest) Sendmessages(allSongs, mostLiked []interface{}) map[string]interface{} {
+func (nwr *NotifyUserRequest) Sendmessages(allSongs, mostLiked []storage.QueueEntry) map[string]interface{} {
 	var successful []string
 	var failed []FailNotification
 	fmt.Println("inside Sendmessages function", 1)
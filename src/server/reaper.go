@@ -0,0 +1,27 @@
+package server
+
+import (
+	"BeatBus/events"
+	"BeatBus/storage"
+	"time"
+)
+
+// how often rooms are checked for having run out of lifetime
+const roomReaperInterval = 30 * time.Second
+
+// reapExpiredRooms ends the sessions of rooms whose lifetime ran out and tells everyone still listening.
+// It runs until the server stops.
+func (s *Server) reapExpiredRooms(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		ended, err := s.rooms.EndExpiredRooms(time.Now())
+		if err != nil {
+			s.logger.Printf("failed to look up expired rooms: %v\n", err)
+			continue
+		}
+		for _, roomID := range ended {
+			s.publishEvent(roomID, events.SessionEnded, "", events.SessionEndedPayload{Reason: storage.SessionExpired})
+		}
+	}
+}
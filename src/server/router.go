@@ -2,6 +2,7 @@ package server
 
 import (
 	"BeatBus/internal"
+	"BeatBus/storage"
 	"io"
 	"log"
 	"net/http"
@@ -10,16 +11,39 @@ import (
 	"github.com/gorilla/mux"
 )
 
-var cfg = internal.GetConfig()
-
 type Server struct {
 	port           string
 	documentLogger *log.Logger
 	cacheLogger    *log.Logger
 	logger         *log.Logger
+	rooms          storage.RoomStore
+	users          storage.UserStore
+	bus            storage.EventBus
+	cache          storage.Cache
 }
 
+// NewServer runs BeatBus on Mongo and Redis
 func NewServer() *Server {
+	s := newServer()
+	mq := storage.NewMessageQueue(s.cacheLogger)
+	internal.UseTokenStore(mq)
+	ds := storage.NewDocumentStore(s.documentLogger).WithPresence(mq)
+	s.rooms, s.users, s.bus, s.cache = ds, ds, mq, mq
+	return s
+}
+
+// NewMemoryServer keeps everything in memory, nothing survives a restart. Meant for local dev and tests.
+func NewMemoryServer() *Server {
+	s := newServer()
+	bus := storage.NewMemoryBus()
+	internal.UseTokenStore(bus)
+	ds := storage.NewMemoryDocumentStore(s.documentLogger).WithPresence(bus)
+	s.rooms, s.users, s.bus, s.cache = ds, ds, bus, bus
+	return s
+}
+
+func newServer() *Server {
+	cfg := internal.GetConfig()
 	logFile, err := os.OpenFile(cfg.OutputFileName, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
 	if err != nil {
 		log.Fatalf("Failed to open log file (%s) due to error: %v", cfg.OutputFileName, err)
@@ -42,16 +66,21 @@ func (s *Server) registerMiddleware(r *mux.Router, middleware []mux.MiddlewareFu
 }
 
 func (s *Server) StartServer() error {
+	go s.reapExpiredRooms(roomReaperInterval)
+	s.logger.Println(" Starting server on port", s.port)
+	http.ListenAndServe(s.port, s.handler())
+	return nil
+}
+
+// handler is every route behind the middleware, the server serves it and tests call it directly
+func (s *Server) handler() http.Handler {
 	middleware := []mux.MiddlewareFunc{
 		Cors,
 		s.SimpleLogger,
 		s.Recover,
+		s.Authenticate,
 	}
-	router := s.registerRoutes()
-	router = s.registerMiddleware(router, middleware)
-	s.logger.Println(" Starting server on port", s.port)
-	http.ListenAndServe(s.port, router)
-	return nil
+	return s.registerMiddleware(s.registerRoutes(), middleware)
 }
 
 func (s *Server) registerRoutes() *mux.Router {
@@ -66,15 +95,36 @@ func (s *Server) registerRoutes() *mux.Router {
 	// Authentication
 	router.HandleFunc("/signUp", s.SignUp).Methods("POST")
 	router.HandleFunc("/login", s.LogIn).Methods("POST")
+	router.HandleFunc("/token/refresh", s.RefreshToken).Methods("POST")
+	router.HandleFunc("/token/revoke", s.RevokeToken).Methods("POST")
 
 	// Rooms
 	router.HandleFunc("/rooms/{roomID}", s.JoinRoom).Methods("GET")
 	router.HandleFunc("/rooms", s.Rooms).Methods("POST", "PUT", "DELETE")
+	router.HandleFunc("/rooms", s.PublicRooms).Methods("GET")
 	router.HandleFunc("/rooms/{roomID}/state", s.RoomState).Methods("GET")
+	router.HandleFunc("/rooms/{roomID}/events", s.RoomEvents).Methods("GET")
+	router.HandleFunc("/rooms/{roomID}/log", s.RoomEventLog).Methods("GET")
+	router.HandleFunc("/rooms/{roomID}/token", s.RoomToken).Methods("GET")
+	router.HandleFunc("/rooms/{roomID}/cohosts/{username}", s.CoHosts).Methods("PUT", "DELETE")
+	router.HandleFunc("/rooms/{roomID}/host", s.TransferHost).Methods("POST")
+	router.HandleFunc("/rooms/{roomID}/kick", s.KickUser).Methods("POST")
+	router.HandleFunc("/rooms/{roomID}/leave", s.LeaveRoom).Methods("POST")
+	router.HandleFunc("/rooms/{roomID}/heartbeat", s.Heartbeat).Methods("POST")
+	router.HandleFunc("/rooms/{roomID}/invite", s.Invite).Methods("GET", "POST")
+	router.HandleFunc("/rooms/{roomID}/invite/qr", s.InviteQR).Methods("GET")
 
 	// Queue
 	router.HandleFunc("/queues/{roomID}/playlist", s.QueuesPlaylist).Methods("POST", "GET", "PUT")
 	router.HandleFunc("/queues/{roomID}/nextSong", s.NextSong).Methods("POST")
+	router.HandleFunc("/queues/{roomID}/skip", s.SkipSong).Methods("POST")
+
+	// Songs
+	router.HandleFunc("/songs/{catalogID}", s.Songs).Methods("GET")
+
+	// Sessions
+	router.HandleFunc("/sessions/{sessionID}", s.Sessions).Methods("GET")
+	router.HandleFunc("/users/{username}/sessions", s.UserSessions).Methods("GET")
 
 	// Metrics
 	router.HandleFunc("/metrics/{roomID}", s.Metrics).Methods("GET", "POST")
@@ -0,0 +1,243 @@
+package server
+
+import (
+	"BeatBus/events"
+	"BeatBus/internal"
+	"BeatBus/storage"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	wsWriteWait  = 10 * time.Second      // time allowed to write a single frame to the client
+	wsPongWait   = 60 * time.Second      // time allowed to read the next pong from the client
+	wsPingPeriod = (wsPongWait * 9) / 10 // must be less than wsPongWait
+
+	sseKeepAlive = 15 * time.Second // comment lines sent so idle proxies don't drop the stream
+	sseRetry     = 3 * time.Second  // how long EventSource clients wait before reconnecting
+
+	presenceRefresh = storage.PresenceTimeout / 3 // how often an open stream marks its user as still in the room and rechecks their access
+)
+
+// reasons a stream is closed when the caller may no longer watch the room
+const (
+	reasonRemoved         = "you are no longer in the room"
+	reasonTokenRevoked    = "your token for this room was revoked, get a new one"
+	reasonPasswordChanged = "the room password changed"
+)
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	// the Cors middleware already allows every origin, the websocket should behave the same way
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// streamMessage is what both the websocket and SSE transports send to clients.
+// Live events carry the room state they produced, replayed events only carry the event.
+type streamMessage struct {
+	Event *events.Event `json:"event,omitempty"`
+	State interface{}   `json:"state,omitempty"`
+}
+
+type outgoingMessage struct {
+	ID      string // event log ID, used as the SSE id
+	Name    string // SSE event name
+	Message streamMessage
+}
+
+// writeMessage sends a stream message to the client as a JSON text frame
+func writeMessage(conn *websocket.Conn, message streamMessage) error {
+	conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+	return conn.WriteJSON(message)
+}
+
+// closeWithReason sends a close frame so the client knows why the connection is being torn down
+func closeWithReason(conn *websocket.Conn, code int, reason string) error {
+	return conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(wsWriteWait))
+}
+
+// readPump drains incoming frames so control frames (ping/pong/close) are processed.
+// The returned channel is closed once the client goes away.
+func readPump(conn *websocket.Conn) <-chan struct{} {
+	done := make(chan struct{})
+	conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	conn.SetPongHandler(func(string) error {
+		conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		return nil
+	})
+	go func() {
+		defer close(done)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	return done
+}
+
+// streamPresence marks the user the stream was opened with as active and returns a channel that ticks
+// whenever the stream should call recheckStream.
+func (s *Server) streamPresence(r *http.Request, roomID string) (<-chan time.Time, func()) {
+	s.refreshPresence(r, roomID)
+	ticker := time.NewTicker(presenceRefresh)
+	return ticker.C, ticker.Stop
+}
+
+func (s *Server) refreshPresence(r *http.Request, roomID string) {
+	claims, ok := roomClaims(r, roomID)
+	if !ok {
+		return // opened with the room password, there is nobody to mark
+	}
+	if err := s.rooms.Heartbeat(roomID, claims.Username); err != nil && err != storage.ErrUserNotInRoom {
+		s.logger.Printf("failed to refresh the presence of %s in room %s: %v\n", claims.Username, roomID, err)
+	}
+}
+
+// roomAccess checks that the caller may read the room's state: either they send a token issued for this
+// room or the room's current password. People who joined with an invite link never see the password.
+func (s *Server) roomAccess(w http.ResponseWriter, r *http.Request, roomID string) bool {
+	if claims, ok := claimsFromContext(r); ok && claims.RoomID == roomID && claims.Role != internal.RoleUser {
+		return true
+	}
+	roomPassword := r.URL.Query().Get("roomPassword")
+	if roomPassword == "" {
+		http.Error(w, "Missing roomPassword parameter or room token", http.StatusBadRequest)
+		return false
+	}
+	switch err := s.rooms.CheckRoomPassword(roomID, roomPassword); err {
+	case nil:
+		return true
+	case storage.ErrRoomDoesntExist:
+		http.Error(w, fmt.Sprintf("Room with ID [ %s ] does not exist", roomID), http.StatusNotFound)
+	case storage.ErrInvalidRoomPassword:
+		http.Error(w, "[The Room Password you provided is incorrect] -> please try again or contact the room host", http.StatusUnauthorized)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+	return false
+}
+
+// recheckStream refreshes the caller's presence and returns why the stream has to close, empty while it may stay open
+func (s *Server) recheckStream(r *http.Request, roomID string) string {
+	s.refreshPresence(r, roomID)
+	return s.streamAccess(r, roomID)
+}
+
+// streamAccess returns why the caller may no longer watch the room, empty while they still may. Streams opened
+// with a token end once it is revoked or its user left or was kicked, streams opened with the password end once it changes.
+// Errors reading the room or the revocation list keep the stream open, they are most likely passing.
+func (s *Server) streamAccess(r *http.Request, roomID string) string {
+	claims, ok := roomClaims(r, roomID)
+	if !ok {
+		switch err := s.rooms.CheckRoomPassword(roomID, r.URL.Query().Get("roomPassword")); err {
+		case nil, storage.ErrRoomDoesntExist:
+			return "" // a room that is gone sends session-ended itself
+		case storage.ErrInvalidRoomPassword:
+			return reasonPasswordChanged
+		default:
+			s.logger.Printf("failed to recheck the password of a stream on room %s: %v\n", roomID, err)
+			return ""
+		}
+	}
+	revoked, err := internal.IsRevoked(claims)
+	if err != nil {
+		s.logger.Printf("failed to check whether the token of %s in room %s was revoked: %v\n", claims.Username, roomID, err)
+	} else if revoked {
+		return reasonTokenRevoked
+	}
+	if _, err := s.rooms.RoomRole(roomID, claims.Username); err == storage.ErrUserNotInRoom {
+		return reasonRemoved
+	}
+	return ""
+}
+
+// roomClaims are the claims of a token issued for roomID, streams opened with the password have none
+func roomClaims(r *http.Request, roomID string) (*internal.Claims, bool) {
+	claims, ok := claimsFromContext(r)
+	if !ok || claims.RoomID != roomID || claims.Role == internal.RoleUser {
+		return nil, false
+	}
+	return claims, true
+}
+
+// changesAccess reports whether the event may have cost someone watching the room their access, see streamAccess
+func changesAccess(event events.Event) bool {
+	switch event.Type {
+	case events.UserKicked, events.UserLeft, events.HostChanged:
+		return true
+	}
+	return false
+}
+
+// writeSSE writes a single Server-Sent Event and flushes it to the client.
+// Strings are sent as is, anything else is encoded as JSON.
+func writeSSE(w http.ResponseWriter, flusher http.Flusher, id, event string, data interface{}) error {
+	var payload string
+	switch d := data.(type) {
+	case string:
+		payload = d
+	default:
+		encoded, err := json.Marshal(d)
+		if err != nil {
+			return err
+		}
+		payload = string(encoded)
+	}
+	if id != "" {
+		if _, err := fmt.Fprintf(w, "id: %s\n", id); err != nil {
+			return err
+		}
+	}
+	if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, payload); err != nil {
+		return err
+	}
+	flusher.Flush()
+	return nil
+}
+
+// alreadySent reports whether the event log ID id is at or before lastSent.
+// IDs look like <unix ms>-<sequence>, events that were never logged have no ID and are always sent.
+func alreadySent(id, lastSent string) bool {
+	if id == "" || lastSent == "" {
+		return false
+	}
+	idMs, idSeq := splitEventID(id)
+	sentMs, sentSeq := splitEventID(lastSent)
+	if idMs != sentMs {
+		return idMs < sentMs
+	}
+	return idSeq <= sentSeq
+}
+
+func splitEventID(id string) (uint64, uint64) {
+	ms, seq, _ := strings.Cut(id, "-")
+	msValue, _ := strconv.ParseUint(ms, 10, 64)
+	seqValue, _ := strconv.ParseUint(seq, 10, 64)
+	return msValue, seqValue
+}
+
+// lastEventID returns the ID a reconnecting client last saw. Browsers send it as a header,
+// the query param is for clients that can't set headers on the initial request.
+func lastEventID(r *http.Request) string {
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		return id
+	}
+	return r.URL.Query().Get("lastEventID")
+}
+
+// sessionEndedReason pulls the human readable reason out of a session-ended event
+func sessionEndedReason(event events.Event) string {
+	var payload events.SessionEndedPayload
+	if err := event.DecodePayload(&payload); err != nil || payload.Reason == "" {
+		return "end session"
+	}
+	return payload.Reason
+}
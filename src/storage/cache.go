@@ -1,11 +1,13 @@
 package storage
 
 import (
+	"BeatBus/events"
 	"BeatBus/internal"
 	"context"
 	"fmt"
 	"log"
 	"slices"
+	"strings"
 	"sync"
 	"time"
 
@@ -19,16 +21,29 @@ type messageQueue struct {
 }
 
 var (
-	cfg                = internal.GetConfig()
 	ErrKeyDoesNotExist = fmt.Errorf("key does not exist")
+	ErrInvalidEventID  = fmt.Errorf("invalid event ID")
 	rdsClient          *redis.Client // singleton instance
 )
 
+const (
+	EventLogMaxLen          = 1000 // events kept per room, older ones are trimmed as new ones are appended
+	EventLogTTLAfterSession = time.Hour
+	eventLogField           = "event"
+)
+
+func eventLogKey(channel string) string {
+	return channel + ":log"
+}
+
 func newRedisClient(redisURI string) *redis.Client {
 	const port = "6379"
 	if rdsClient != nil {
 		return rdsClient
 	}
+	if redisURI == "" {
+		panic("REDIS_URI is not set, run with --memory to use the in-memory event bus instead")
+	}
 	client := redis.NewClient(&redis.Options{
 		Addr:     redisURI + ":" + port,
 		Password: "", // No password set
@@ -43,8 +58,8 @@ func newRedisClient(redisURI string) *redis.Client {
 	rdsClient = client
 	return client
 }
-func NewMessageQueue(l *log.Logger) *messageQueue {
-	client := newRedisClient(cfg.RedisURI)
+func NewMessageQueue(l *log.Logger) Broker {
+	client := newRedisClient(internal.GetConfig().RedisURI)
 	return &messageQueue{
 		client: client,
 		logger: l,
@@ -61,6 +76,13 @@ func (mq *messageQueue) EnsureKeyExists(key string) error {
 	}
 	return nil
 }
+func (mq *messageQueue) GetKey(key string) (string, error) {
+	val, err := mq.client.Get(context.Background(), key).Result()
+	if err == redis.Nil {
+		return "", ErrKeyDoesNotExist
+	}
+	return val, err
+}
 func (mq *messageQueue) SetKeyWithExpiry(key string, value interface{}, expiration time.Duration) error {
 	ctx := context.Background()
 	mq.mu.Lock()
@@ -83,26 +105,235 @@ func (mq *messageQueue) Incr(key string) error {
 	}
 	return nil
 }
-func (mq *messageQueue) UpdateChannel(channel string, message interface{}) error {
+
+// presence is kept in a sorted set per room scored by when each user was last seen in unix millis.
+// The set and its entries go away once nobody in the room was seen for presenceRetention.
+const presenceRetention = time.Hour
+
+func presenceKey(roomID string) string {
+	return "presence:" + roomID
+}
+
+func (mq *messageQueue) Touch(roomID, username string, at time.Time) error {
+	ctx := context.Background()
+	key := presenceKey(roomID)
+	_, err := mq.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZAdd(ctx, key, &redis.Z{Score: float64(at.UnixMilli()), Member: username})
+		pipe.Expire(ctx, key, presenceRetention)
+		return nil
+	})
+	return err
+}
+
+func (mq *messageQueue) Forget(roomID, username string) error {
+	return mq.client.ZRem(context.Background(), presenceKey(roomID), username).Err()
+}
+
+func (mq *messageQueue) SeenSince(roomID string, since time.Time) ([]string, error) {
+	ctx := context.Background()
+	key := presenceKey(roomID)
+	stale := fmt.Sprintf("(%d", time.Now().Add(-presenceRetention).UnixMilli())
+	if err := mq.client.ZRemRangeByScore(ctx, key, "-inf", stale).Err(); err != nil {
+		return nil, err
+	}
+	return mq.client.ZRangeByScore(ctx, key, &redis.ZRangeBy{
+		Min: fmt.Sprint(since.UnixMilli()),
+		Max: "+inf",
+	}).Result()
+}
+
+// revoked token IDs are plain keys that expire with the token, the tokens of a group are a sorted set
+// scored by when each token expires
+func revokedKey(jti string) string {
+	return "revoked:" + jti
+}
+
+func tokenGroupKey(group string) string {
+	return "tokens:" + group
+}
+
+func (mq *messageQueue) Revoke(jti string, until time.Time) (bool, error) {
+	ttl := time.Until(until)
+	if ttl <= 0 {
+		return false, nil // already expired, nothing to revoke
+	}
+	// SETNX so only the first of several racing revocations reports it did it
+	return mq.client.SetNX(context.Background(), revokedKey(jti), 1, ttl).Result()
+}
+
+func (mq *messageQueue) IsRevoked(jti string) (bool, error) {
+	n, err := mq.client.Exists(context.Background(), revokedKey(jti)).Result()
+	return n > 0, err
+}
+
+func (mq *messageQueue) Track(group, jti string, until time.Time) error {
+	ctx := context.Background()
+	key := tokenGroupKey(group)
+	// drop the tokens that expired on their own so long rooms don't pile up refreshed tokens
+	expired := fmt.Sprintf("(%d", time.Now().Unix())
+	if err := mq.client.ZRemRangeByScore(ctx, key, "-inf", expired).Err(); err != nil {
+		return err
+	}
+	err := mq.client.ZAdd(ctx, key, &redis.Z{Score: float64(until.Unix()), Member: jti}).Err()
+	if err != nil {
+		return err
+	}
+	// the group lives as long as its longest lived token
+	last, err := mq.client.ZRevRangeWithScores(ctx, key, 0, 0).Result()
+	if err != nil || len(last) == 0 {
+		return err
+	}
+	return mq.client.ExpireAt(ctx, key, time.Unix(int64(last[0].Score), 0)).Err()
+}
+
+func (mq *messageQueue) RevokeGroup(group string) error {
 	ctx := context.Background()
-	err := mq.client.Publish(ctx, channel, message).Err()
+	key := tokenGroupKey(group)
+	tokens, err := mq.client.ZRangeByScoreWithScores(ctx, key, &redis.ZRangeBy{
+		Min: fmt.Sprint(time.Now().Unix()),
+		Max: "+inf",
+	}).Result()
+	if err != nil {
+		return err
+	}
+	for _, token := range tokens {
+		if _, err := mq.Revoke(token.Member.(string), time.Unix(int64(token.Score), 0)); err != nil {
+			return err
+		}
+	}
+	return mq.client.Del(ctx, key).Err()
+}
+
+// UpdateChannel appends the event to the channel's log and then publishes it to live subscribers.
+// The published copy carries the log ID so clients can resume from it with ReadEvents.
+func (mq *messageQueue) UpdateChannel(channel string, event events.Event) error {
+	ctx := context.Background()
+	logged, err := event.Encode()
+	if err != nil {
+		mq.logger.Println("Failed to encode event:", err)
+		return err
+	}
+	id, err := mq.client.XAdd(ctx, &redis.XAddArgs{
+		Stream: eventLogKey(channel),
+		MaxLen: EventLogMaxLen,
+		Approx: true,
+		Values: map[string]interface{}{eventLogField: logged},
+	}).Result()
+	if err != nil {
+		// the live update is still worth sending even if it can't be replayed later
+		mq.logger.Println("Failed to append event to log:", err)
+	} else {
+		event.ID = id
+	}
+	if event.Type == events.SessionEnded {
+		// keep the log around long enough for clients that were offline to see the session end
+		mq.client.Expire(ctx, eventLogKey(channel), EventLogTTLAfterSession)
+	}
+	message, err := event.Encode()
+	if err != nil {
+		mq.logger.Println("Failed to encode event:", err)
+		return err
+	}
+	err = mq.client.Publish(ctx, channel, message).Err()
 	if err != nil {
 		mq.logger.Println("Failed to publish message to channel:", err)
 		return err
 	}
-	mq.logger.Printf("Published message to channel %s: %v\n", channel, message)
+	mq.logger.Printf("Published %s event %s to channel %s\n", event.Type, event.ID, channel)
 	return nil
 }
-func (mq *messageQueue) SubscribeChannel(channel string) *redis.PubSub {
+
+// ReadEvents returns the logged events of a channel that came after afterID, oldest first.
+// An empty afterID reads the log from the beginning.
+func (mq *messageQueue) ReadEvents(channel, afterID string) ([]events.Event, error) {
+	ctx := context.Background()
+	start := "-"
+	if afterID != "" {
+		start = "(" + afterID // exclusive range, requires redis >= 6.2
+	}
+	entries, err := mq.client.XRangeN(ctx, eventLogKey(channel), start, "+", EventLogMaxLen).Result()
+	if err != nil {
+		if strings.Contains(err.Error(), "Invalid stream ID") {
+			return nil, ErrInvalidEventID
+		}
+		return nil, err
+	}
+	logged := make([]events.Event, 0, len(entries))
+	for _, entry := range entries {
+		raw, ok := entry.Values[eventLogField].(string)
+		if !ok {
+			continue
+		}
+		event, err := events.Decode([]byte(raw))
+		if err != nil {
+			mq.logger.Printf("skipping unreadable event %s in %s: %v\n", entry.ID, eventLogKey(channel), err)
+			continue
+		}
+		event.ID = entry.ID
+		logged = append(logged, event)
+	}
+	return logged, nil
+}
+
+// LastEventID returns the ID of the newest logged event of a channel, or "" if nothing has been logged yet
+func (mq *messageQueue) LastEventID(channel string) (string, error) {
+	ctx := context.Background()
+	entries, err := mq.client.XRevRangeN(ctx, eventLogKey(channel), "+", "-", 1).Result()
+	if err != nil {
+		return "", err
+	}
+	if len(entries) == 0 {
+		return "", nil
+	}
+	return entries[0].ID, nil
+}
+
+func (mq *messageQueue) SubscribeChannel(channel string) (Subscription, error) {
 	ctx := context.Background()
 	pubsub := mq.client.Subscribe(ctx, channel)
 	// Wait for confirmation that subscription is created before publishing anything.
 	_, err := pubsub.Receive(ctx)
 	if err != nil {
 		mq.logger.Println("Failed to subscribe to channel:", err)
-		return nil
+		pubsub.Close()
+		return nil, err
+	}
+	sub := &redisSubscription{pubsub: pubsub, events: make(chan events.Event), done: make(chan struct{})}
+	go sub.decode(mq.logger, channel)
+	return sub, nil
+}
+
+// redisSubscription turns the messages of a redis subscription into events
+type redisSubscription struct {
+	pubsub    *redis.PubSub
+	events    chan events.Event
+	done      chan struct{} // closed by Close, so decode doesn't wait on a reader that is gone
+	closeOnce sync.Once
+}
+
+func (rs *redisSubscription) decode(logger *log.Logger, channel string) {
+	defer close(rs.events)
+	for msg := range rs.pubsub.Channel() {
+		event, err := events.Decode([]byte(msg.Payload))
+		if err != nil {
+			logger.Printf("skipping malformed event on %s: %v\n", channel, err)
+			continue
+		}
+		select {
+		case rs.events <- event:
+		case <-rs.done:
+			return
+		}
 	}
-	return pubsub
+}
+
+func (rs *redisSubscription) Events() <-chan events.Event {
+	return rs.events
+}
+
+func (rs *redisSubscription) Close() error {
+	rs.closeOnce.Do(func() { close(rs.done) })
+	return rs.pubsub.Close()
 }
 
 type accumulateResults struct {
@@ -0,0 +1,90 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const SongsCollection = "songs"
+
+var ErrSongNotInCatalog = fmt.Errorf("song is not in the catalog")
+
+// CatalogSong is the identity a track keeps across queues, rooms and sessions.
+// Queue entries point at it through their catalogId, the stats are added to whenever a session ends.
+type CatalogSong struct {
+	CatalogID    string    `bson:"_id" json:"catalogId"`
+	ExternalID   string    `bson:"externalId,omitempty" json:"externalId,omitempty"` // id from a streaming service, if the client sent one
+	Title        string    `bson:"title" json:"title"`
+	Artist       string    `bson:"artist" json:"artist"`
+	Album        string    `bson:"album" json:"album"`
+	Plays        int64     `bson:"plays" json:"plays"`
+	Skips        int64     `bson:"skips" json:"skips"`
+	Likes        int64     `bson:"likes" json:"likes"`
+	Dislikes     int64     `bson:"dislikes" json:"dislikes"`
+	Rooms        []string  `bson:"rooms" json:"rooms"` // rooms the song was played in
+	FirstAddedAt time.Time `bson:"firstAddedAt" json:"firstAddedAt"`
+	LastPlayedAt time.Time `bson:"lastPlayedAt,omitempty" json:"lastPlayedAt,omitzero"`
+}
+
+// CatalogID is the same for every add of the same track. An external id wins when there is one,
+// otherwise title, artist and album are normalized so "Song  Name" and "song name" match.
+func CatalogID(title, artist, album, externalID string) string {
+	key := "ext:" + strings.TrimSpace(externalID)
+	if strings.TrimSpace(externalID) == "" {
+		key = strings.Join([]string{normalizeSongField(title), normalizeSongField(artist), normalizeSongField(album)}, "|")
+	}
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:16])
+}
+
+func normalizeSongField(s string) string {
+	return strings.Join(strings.Fields(strings.ToLower(s)), " ")
+}
+
+// UpsertCatalogSong makes sure the track is in the catalog and returns its catalog id
+func (ds *DocumentStore) UpsertCatalogSong(title, artist, album, externalID string) (string, error) {
+	song := CatalogSong{
+		CatalogID:    CatalogID(title, artist, album, externalID),
+		ExternalID:   externalID,
+		Title:        title,
+		Artist:       artist,
+		Album:        album,
+		Rooms:        []string{},
+		FirstAddedAt: time.Now(),
+	}
+	if err := ds.backend.upsertCatalogSong(&song); err != nil {
+		return "", err
+	}
+	return song.CatalogID, nil
+}
+
+func (ds *DocumentStore) GetCatalogSong(catalogID string) (CatalogSong, error) {
+	song, err := ds.backend.findCatalogSong(catalogID)
+	if err != nil {
+		return CatalogSong{}, err
+	}
+	return *song, nil
+}
+
+// recordSessionInCatalog adds the plays and votes of a finished session to the catalog.
+// Songs queued before the catalog existed have no catalogId and are left out.
+func (ds *DocumentStore) recordSessionInCatalog(roomID string, playedSongs []QueueEntry) error {
+	var plays []catalogPlay
+	for _, entry := range playedSongs {
+		if entry.Song.CatalogID == "" {
+			continue
+		}
+		plays = append(plays, catalogPlay{
+			CatalogID: entry.Song.CatalogID,
+			RoomID:    roomID,
+			Played:    !entry.Skipped,
+			Likes:     entry.Song.Metadata.Likes,
+			Dislikes:  entry.Song.Metadata.Dislikes,
+			PlayedAt:  entry.PlayedAt,
+		})
+	}
+	return ds.backend.recordCatalogPlays(plays)
+}
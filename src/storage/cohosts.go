@@ -0,0 +1,209 @@
+package storage
+
+import (
+	"BeatBus/internal"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// what the host can hand to a co-host. Ending the session and changing the room settings stay with the host.
+const (
+	PermissionReorder = "reorder"
+	PermissionSkip    = "skip"
+	PermissionKick    = "kick"
+)
+
+var CoHostPermissions = []string{PermissionReorder, PermissionSkip, PermissionKick}
+
+var (
+	ErrInvalidPermission  = fmt.Errorf("permissions must be one or more of %v", CoHostPermissions)
+	ErrNotRoomHost        = fmt.Errorf("only the host of the room can do that")
+	ErrUserNotInRoom      = fmt.Errorf("user is not in the room")
+	ErrNotCoHost          = fmt.Errorf("user is not a co-host of the room")
+	ErrHostCantBeCoHost   = fmt.Errorf("the host already has every permission")
+	ErrAlreadyHost        = fmt.Errorf("you are already the host of this room")
+	ErrNewHostUnavailable = fmt.Errorf("the new host needs an account and can't be hosting another session")
+	ErrPermissionDenied   = fmt.Errorf("you don't have permission to do that in this room")
+)
+
+// CoHost is a guest the host trusts with some of the host's powers
+type CoHost struct {
+	Username    string   `bson:"username" json:"username"`
+	Permissions []string `bson:"permissions" json:"permissions"`
+}
+
+// RoomRole is what a user currently is in a room. It is read from the room rather than the user's token
+// so promotions, demotions and host transfers apply right away.
+type RoomRole struct {
+	Role        string   `json:"role"`
+	Permissions []string `json:"permissions"`
+}
+
+// Can reports whether the role allows permission, the host can do everything
+func (rr RoomRole) Can(permission string) bool {
+	return rr.Role == internal.RoleHost || slices.Contains(rr.Permissions, permission)
+}
+
+// HostTransfer is what the previous host gets back after handing the room over
+type HostTransfer struct {
+	RoomID         string      `json:"roomID"`
+	HostID         string      `json:"hostID"`
+	PreviousHostID string      `json:"previousHostID"`
+	AccessToken    AccessToken `json:"accessToken"` // guest tokens for the previous host
+}
+
+// coHostsOf never returns nil so clients always get a list
+func coHostsOf(room *Room) []CoHost {
+	if room.CoHosts == nil {
+		return []CoHost{}
+	}
+	return room.CoHosts
+}
+
+func roomRole(room *Room, username string) (RoomRole, error) {
+	if room.HostID == username {
+		return RoomRole{Role: internal.RoleHost, Permissions: CoHostPermissions}, nil
+	}
+	if i := slices.IndexFunc(room.CoHosts, func(c CoHost) bool { return c.Username == username }); i != -1 {
+		return RoomRole{Role: internal.RoleCoHost, Permissions: room.CoHosts[i].Permissions}, nil
+	}
+	if slices.Contains(room.UsersJoined, username) {
+		return RoomRole{Role: internal.RoleGuest, Permissions: []string{}}, nil
+	}
+	return RoomRole{}, ErrUserNotInRoom
+}
+
+// RoomRole returns what username currently is in the room, ErrUserNotInRoom if they never joined it
+func (ds *DocumentStore) RoomRole(roomID, username string) (RoomRole, error) {
+	room, err := ds.findRoom(roomID)
+	if err != nil {
+		return RoomRole{}, err
+	}
+	return roomRole(room, username)
+}
+
+// RoomToken issues username tokens for the role they currently have in the room
+func (ds *DocumentStore) RoomToken(roomID, username string) (AccessToken, RoomRole, error) {
+	room, err := ds.findRoom(roomID)
+	if err != nil {
+		return AccessToken{}, RoomRole{}, err
+	}
+	role, err := roomRole(room, username)
+	if err != nil {
+		return AccessToken{}, RoomRole{}, err
+	}
+	return newAccessToken(username, roomID, role.Role, room.TimeLeft()), role, nil
+}
+
+// SetCoHost makes username a co-host with permissions, or changes the permissions of an existing co-host
+func (ds *DocumentStore) SetCoHost(roomID, hostUsername, username string, permissions []string) ([]CoHost, error) {
+	if len(permissions) == 0 {
+		return nil, ErrInvalidPermission
+	}
+	for _, permission := range permissions {
+		if !slices.Contains(CoHostPermissions, permission) {
+			return nil, ErrInvalidPermission
+		}
+	}
+	// sorted on a copy, the caller's slice is left as it was
+	permissions = slices.Clone(permissions)
+	slices.Sort(permissions)
+	permissions = slices.Compact(permissions)
+	var coHosts []CoHost
+	err := ds.updateRoomVersioned(roomID, func(room *Room) error {
+		if room.HostID != hostUsername {
+			return ErrNotRoomHost
+		}
+		if username == room.HostID {
+			return ErrHostCantBeCoHost
+		}
+		if !slices.Contains(room.UsersJoined, username) {
+			return ErrUserNotInRoom
+		}
+		coHost := CoHost{Username: username, Permissions: permissions}
+		if i := slices.IndexFunc(room.CoHosts, func(c CoHost) bool { return c.Username == username }); i != -1 {
+			room.CoHosts[i] = coHost
+		} else {
+			room.CoHosts = append(room.CoHosts, coHost)
+		}
+		coHosts = room.CoHosts
+		return nil
+	})
+	return coHosts, err
+}
+
+// RemoveCoHost turns a co-host back into a guest
+func (ds *DocumentStore) RemoveCoHost(roomID, hostUsername, username string) ([]CoHost, error) {
+	var coHosts []CoHost
+	err := ds.updateRoomVersioned(roomID, func(room *Room) error {
+		if room.HostID != hostUsername {
+			return ErrNotRoomHost
+		}
+		before := len(room.CoHosts)
+		room.CoHosts = slices.DeleteFunc(room.CoHosts, func(c CoHost) bool { return c.Username == username })
+		if len(room.CoHosts) == before {
+			return ErrNotCoHost
+		}
+		coHosts = coHostsOf(room)
+		return nil
+	})
+	return coHosts, err
+}
+
+// TransferHost hands the room from hostUsername to newHost, who has to be in the room and have an account.
+// The new host fetches their host token with RoomToken. Every token the previous host had for the room
+// is revoked and they are handed guest tokens instead. The inSession flag moves along with the room.
+func (ds *DocumentStore) TransferHost(roomID, hostUsername, newHost string) (HostTransfer, error) {
+	if newHost == hostUsername {
+		return HostTransfer{}, ErrAlreadyHost
+	}
+	var transfer HostTransfer
+	var timeLeft time.Duration
+	claimed := false
+	err := ds.updateRoomVersioned(roomID, func(room *Room) error {
+		if room.HostID != hostUsername {
+			return ErrNotRoomHost
+		}
+		if !slices.Contains(room.UsersJoined, newHost) {
+			return ErrUserNotInRoom
+		}
+		// the new host's inSession is claimed once, a retry after a version conflict keeps the claim
+		if !claimed {
+			ok, err := ds.claimSession(newHost)
+			if err == ErrUserNotFound || (err == nil && !ok) {
+				return ErrNewHostUnavailable
+			} else if err != nil {
+				return err
+			}
+			claimed = true
+		}
+		room.HostID = newHost
+		room.CoHosts = slices.DeleteFunc(room.CoHosts, func(c CoHost) bool { return c.Username == newHost })
+		transfer = HostTransfer{
+			RoomID:         roomID,
+			HostID:         newHost,
+			PreviousHostID: hostUsername,
+		}
+		timeLeft = room.TimeLeft()
+		return nil
+	})
+	if err != nil {
+		if claimed {
+			// the room wasn't handed over, the new host is free to host their own room again
+			if err := ds.setInSession(newHost, false); err != nil {
+				ds.logger.Printf("failed to set user %s inSession to false: %v\n", newHost, err)
+			}
+		}
+		return HostTransfer{}, err
+	}
+	if err := internal.RevokeUserRoomTokens(roomID, hostUsername); err != nil {
+		ds.logger.Printf("failed to revoke the host tokens of %s in room %s: %v\n", hostUsername, roomID, err)
+	}
+	transfer.AccessToken = newAccessToken(hostUsername, roomID, internal.RoleGuest, timeLeft)
+	if err := ds.setInSession(hostUsername, false); err != nil {
+		ds.logger.Printf("failed to set user %s inSession to false: %v\n", hostUsername, err)
+	}
+	ds.logger.Printf("room %s was handed from %s to %s\n", roomID, hostUsername, newHost)
+	return transfer, nil
+}
@@ -0,0 +1,134 @@
+package storage
+
+import (
+	"cmp"
+	"fmt"
+	"time"
+)
+
+// how public rooms can be ordered, popular is the default
+const (
+	SortPopular = "popular" // most users in the room first
+	SortNewest  = "newest"  // latest start first
+)
+
+const (
+	DefaultPublicRoomLimit = 20
+	MaxPublicRoomLimit     = 50
+)
+
+var (
+	ErrInvalidRoomSort = fmt.Errorf("sort must be %s or %s", SortPopular, SortNewest)
+	ErrInvalidRoomPage = fmt.Errorf("limit must be between 1 and %d and offset can't be negative", MaxPublicRoomLimit)
+	ErrRoomIsPrivate   = fmt.Errorf("this room is private, a room password or invite is needed to join")
+)
+
+// PublicRoomQuery picks which page of the public rooms to list, Search matches the room name ignoring case
+type PublicRoomQuery struct {
+	Search string
+	Sort   string
+	Limit  int
+	Offset int
+}
+
+// PublicRoom is what anyone can see of a public room, never its password
+type PublicRoom struct {
+	RoomID            string      `json:"roomID"`
+	Name              string      `json:"name"`
+	HostID            string      `json:"hostID"`
+	ActiveUsers       int         `json:"activeUsers"`
+	TotalParticipants int         `json:"totalParticipants"`
+	MaxUsers          int64       `json:"maxUsers"`
+	NowPlaying        *NowPlaying `json:"nowPlaying"`
+	TimeLeft          int64       `json:"timeLeft"` // seconds
+	Scheduled         bool        `json:"scheduled"`
+	StartsAt          int64       `json:"startsAt,omitempty"` // unix seconds, only for scheduled rooms
+}
+
+// NowPlaying is the song a public room is playing, with vote counts but not who voted
+type NowPlaying struct {
+	SongID   string    `json:"songId"`
+	Stats    SongStats `json:"stats"`
+	AddedBy  string    `json:"addedBy"`
+	Likes    int       `json:"likes"`
+	Dislikes int       `json:"dislikes"`
+}
+
+type PublicRoomPage struct {
+	Rooms  []PublicRoom `json:"rooms"`
+	Total  int          `json:"total"` // public rooms matching the search, across all pages
+	Limit  int          `json:"limit"`
+	Offset int          `json:"offset"`
+}
+
+// PublicRooms lists the public rooms that haven't ended. The backend filters, sorts and pages them,
+// presence is only read for the rooms on the page.
+func (ds *DocumentStore) PublicRooms(query PublicRoomQuery) (PublicRoomPage, error) {
+	if query.Sort == "" {
+		query.Sort = SortPopular
+	}
+	if query.Sort != SortPopular && query.Sort != SortNewest {
+		return PublicRoomPage{}, ErrInvalidRoomSort
+	}
+	if query.Limit == 0 {
+		query.Limit = DefaultPublicRoomLimit
+	}
+	if query.Limit < 1 || query.Limit > MaxPublicRoomLimit || query.Offset < 0 {
+		return PublicRoomPage{}, ErrInvalidRoomPage
+	}
+	now := time.Now()
+	rooms, total, err := ds.backend.findPublicRooms(now, query)
+	if err != nil {
+		return PublicRoomPage{}, err
+	}
+	page := PublicRoomPage{Rooms: make([]PublicRoom, 0, len(rooms)), Total: total, Limit: query.Limit, Offset: query.Offset}
+	for _, room := range rooms {
+		page.Rooms = append(page.Rooms, publicRoomOf(room, len(ds.activeUsers(room)), now))
+	}
+	return page, nil
+}
+
+// publicRoomOrder is how public rooms are listed for sort: the newest start first, or for popular the most
+// users in the room, then the most participants. The room ID breaks ties so pages don't overlap.
+func publicRoomOrder(sort string) func(a, b *Room) int {
+	newestFirst := func(a, b *Room) int {
+		return cmp.Or(b.StartTime().Compare(a.StartTime()), cmp.Compare(a.RoomID, b.RoomID))
+	}
+	if sort == SortNewest {
+		return newestFirst
+	}
+	return func(a, b *Room) int {
+		return cmp.Or(
+			cmp.Compare(len(b.UsersJoined), len(a.UsersJoined)),
+			cmp.Compare(len(participantsOf(b)), len(participantsOf(a))),
+			newestFirst(a, b),
+		)
+	}
+}
+
+func publicRoomOf(room *Room, activeUsers int, now time.Time) PublicRoom {
+	public := PublicRoom{
+		RoomID:            room.RoomID,
+		Name:              room.Stats.Name,
+		HostID:            room.HostID,
+		ActiveUsers:       activeUsers,
+		TotalParticipants: len(participantsOf(room)),
+		MaxUsers:          room.Stats.MaxUsers,
+		TimeLeft:          int64(room.EndTime().Sub(now).Seconds()),
+		Scheduled:         room.Scheduled(now),
+	}
+	if len(room.CurrentQueue) > 0 {
+		song := room.CurrentQueue[0].Song
+		public.NowPlaying = &NowPlaying{
+			SongID:   song.SongID,
+			Stats:    song.Stats,
+			AddedBy:  song.Metadata.AddedBy,
+			Likes:    song.Metadata.Likes,
+			Dislikes: song.Metadata.Dislikes,
+		}
+	}
+	if public.Scheduled {
+		public.StartsAt = room.StartTime().Unix()
+	}
+	return public
+}
@@ -1,33 +1,53 @@
 package storage
 
 import (
+	"BeatBus/events"
 	"BeatBus/internal"
 	"context"
 	"fmt"
 	"log"
+	"slices"
 	"sort"
 	"strings"
 	"sync"
 	"time"
 
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 var (
 	ErrUserNameTaken                    = fmt.Errorf("username already taken")
+	ErrUserNotFound                     = fmt.Errorf("user not found")
 	ErrCannotCreateRoomAlreadyInSession = fmt.Errorf("cannot create room, user already hosting a session")
 	ErrRoomDoesntExist                  = fmt.Errorf("room does not exist")
 	ErrInvalidRoomPassword              = fmt.Errorf("invalid room password")
 	ErrUserAlreadyInRoom                = fmt.Errorf("user already in room")
 	ErrRoomFull                         = fmt.Errorf("room is full")
-	ErrInvalidSongOperation             = func(operation string) error {
-		return fmt.Errorf("[%s] is not a valid song action | Valid actions are [like, unlike, dislike, undislike]", operation)
-	}
-	ErrQueueIsEmpty  = fmt.Errorf("the queue is empty")
-	ErrNoSongsPlayed = fmt.Errorf("no songs have been played in this room yet")
+	ErrInvalidCredentials               = fmt.Errorf("user not found with provided username and password")
+	ErrRoomExpired                      = fmt.Errorf("room has reached the end of its lifetime")
+	ErrInvalidSongOperation             = fmt.Errorf("is not a valid song action | Valid actions are [like, unlike, dislike, undislike]")
+	ErrQueueIsEmpty                     = fmt.Errorf("the queue is empty")
+	ErrInvalidQueueOrder                = fmt.Errorf("the new order must contain every song currently in the queue exactly once")
+	ErrSongNotInQueue                   = fmt.Errorf("song is not in the queue")
+	ErrAlreadyVotedToSkip               = fmt.Errorf("you already voted to skip this song")
+	ErrConcurrentRoomUpdate             = fmt.Errorf("the room is being updated by too many requests at once, please try again")
+	ErrSessionNotFound                  = fmt.Errorf("session not found")
+	ErrInvalidLifetime                  = fmt.Errorf("lifetime must be between 1 and %d minutes", MaxRoomLifetime)
+	ErrLifetimeInPast                   = fmt.Errorf("the new lifetime would end the room in the past, end the session instead")
+	ErrInvalidStartTime                 = fmt.Errorf("a scheduled room has to start in the future and at most %s from now", MaxScheduleAhead)
+	ErrRoomNotStarted                   = fmt.Errorf("the room hasn't started yet, songs can be queued but nothing plays until the start time")
+)
+
+// errRoomStillRunning stops EndExpiredRooms from ending a room whose lifetime was extended after it was found
+var errRoomStillRunning = fmt.Errorf("the room's lifetime was extended")
+
+// number of times a versioned room update is retried before giving up
+const maxVersionedRetries = 10
+
+const (
+	MaxRoomLifetime  = 300 // minutes a room can have left to run, at creation and when its lifetime changes
+	MaxScheduleAhead = 7 * 24 * time.Hour
 )
 
 const (
@@ -35,13 +55,20 @@ const (
 	UsersCollection    = "users"
 	UserInfoCollection = "usersInfo"
 	RoomsCollection    = "rooms"
+	SessionsCollection = "sessions"
+)
+
+// why a session ended, sent to listeners and kept in the archive
+const (
+	SessionEndedByHost = "host ended the session"
+	SessionExpired     = "the room reached the end of its lifetime"
 )
 
 type DocumentStore struct {
-	client *mongo.Client
-	db     *mongo.Database
-	logger *log.Logger
-	mu     sync.RWMutex
+	backend  backend
+	presence Presence // nil counts everyone in a room as active, see WithPresence
+	logger   *log.Logger
+	mu       sync.RWMutex
 }
 
 var (
@@ -52,6 +79,9 @@ func newMongoClient(mongoURI string) *mongo.Client {
 	if mongoClient != nil {
 		return mongoClient
 	}
+	if mongoURI == "" {
+		panic("MONGO_URI is not set, run with --memory to use the in-memory store instead")
+	}
 	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI(mongoURI))
 	if err != nil {
 		fmt.Printf("Failed to connect to MongoDB: mongoURI = %s\n", mongoURI)
@@ -61,307 +91,412 @@ func newMongoClient(mongoURI string) *mongo.Client {
 	return client
 }
 func NewDocumentStore(l *log.Logger) *DocumentStore {
-	client := newMongoClient(cfg.MongoURI)
-	db := client.Database(MongoDBName)
+	client := newMongoClient(internal.GetConfig().MongoURI)
 	return &DocumentStore{
-		client: client,
-		db:     db,
-		logger: l,
+		backend: &mongoBackend{db: client.Database(MongoDBName)},
+		logger:  l,
 	}
 }
 
-func (ds *DocumentStore) InsertNewUser(username, hashedPassword string) error {
-	ds.mu.Lock()
-	defer ds.mu.Unlock()
-
-	collection := ds.db.Collection(UsersCollection)
-	ctx := context.Background()
+// NewMemoryDocumentStore keeps everything in memory, for tests and running BeatBus without Mongo.
+// Nothing is shared between stores, so create one and hand it to everything that needs it.
+func NewMemoryDocumentStore(l *log.Logger) *DocumentStore {
+	return &DocumentStore{
+		backend: newMemoryBackend(),
+		logger:  l,
+	}
+}
 
-	// Check if username already exists
-	count, err := collection.CountDocuments(ctx, bson.M{"username": username})
+// InsertNewUser creates an account, the password is stored as a salted bcrypt hash
+func (ds *DocumentStore) InsertNewUser(username, password string) error {
+	hashedPassword, err := internal.HashPassword(password)
 	if err != nil {
 		return err
 	}
-	if count > 0 {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	// Check if username already exists
+	_, err = ds.backend.findUser(username)
+	if err == nil {
 		return ErrUserNameTaken
+	} else if err != ErrUserNotFound {
+		return err
 	}
 
 	// Insert new user
-	res, err := collection.InsertOne(ctx, bson.M{
-		"username": username,
-		"password": hashedPassword,
+	id, err := ds.backend.insertUser(&User{
+		Username: username,
+		Password: hashedPassword,
 	})
 	if err != nil {
 		ds.logger.Println("Error inserting new user:", err)
 		return err
 	}
-	id := res.InsertedID.(primitive.ObjectID).Hex()
 	err = ds.insertNewUserInfo(id) //insert user info in a separate go routine
 	return err
 }
 func (ds *DocumentStore) insertNewUserInfo(id string) error {
-	collection := ds.db.Collection(UserInfoCollection)
-	ctx := context.Background()
-
 	//dont need to check if it exists because of foreign key relationship with users collection
-	_, err := collection.InsertOne(ctx, bson.M{
-		"user_id":           id,
-		"inSession":         false,
-		"join_date":         time.Now(),
-		"previous_sessions": []string{},
-		"listened_to":       []string{},
-		"liked_songs":       []string{},
-		"disliked_songs":    []string{},
+	return ds.backend.insertUserInfo(&UserInfo{
+		UserID:           id,
+		InSession:        false,
+		JoinDate:         time.Now(),
+		PreviousSessions: []string{},
+		ListenedTo:       []string{},
+		LikedSongs:       []string{},
+		DislikedSongs:    []string{},
 	})
-	return err
 }
 
-func (ds *DocumentStore) ValidateUser(username, hashedPassword string) error {
+// ValidateUser checks username's password. Hashes from before bcrypt, or with an outdated cost,
+// are replaced with a fresh one once the password is known to be right.
+func (ds *DocumentStore) ValidateUser(username, password string) error {
 	ds.mu.RLock()
-	defer ds.mu.RUnlock()
-
-	collection := ds.db.Collection(UsersCollection)
-	ctx := context.Background()
-
-	var result bson.M
-	err := collection.FindOne(ctx, bson.M{"username": username, "password": hashedPassword}).Decode(&result)
-	if err == mongo.ErrNoDocuments {
-		return fmt.Errorf("user not found with provided username and password")
+	user, err := ds.backend.findUser(username)
+	ds.mu.RUnlock()
+	if err == ErrUserNotFound {
+		return ErrInvalidCredentials
 	} else if err != nil {
 		return err // Some other error
 	}
 
+	ok, rehash := internal.CheckPassword(user.Password, password)
+	if !ok {
+		return ErrInvalidCredentials
+	}
+	if rehash {
+		hashedPassword, err := internal.HashPassword(password)
+		if err == nil {
+			err = ds.backend.updateUserPassword(username, hashedPassword)
+		}
+		if err != nil {
+			ds.logger.Printf("failed to rehash the password of user %s: %v\n", username, err)
+		}
+	}
 	return nil // Valid credentials
 }
-func (ds *DocumentStore) inSession(username string) bool {
+
+// UserExists reports whether username belongs to an account
+func (ds *DocumentStore) UserExists(username string) (bool, error) {
 	ds.mu.RLock()
 	defer ds.mu.RUnlock()
-
-	collection := ds.db.Collection(UsersCollection)
-	ctx := context.Background()
-
-	var user bson.M
-	err := collection.FindOne(ctx, bson.M{"username": username}).Decode(&user)
-	if err != nil {
-		return false // User not found or some error occurred
+	_, err := ds.backend.findUser(username)
+	switch err {
+	case nil:
+		return true, nil
+	case ErrUserNotFound:
+		return false, nil
+	default:
+		return false, err
 	}
-
-	userID := user["_id"].(primitive.ObjectID).Hex()
-	ds.logger.Println("userID:", userID)
-	var userInfo bson.M
-	infoCollection := ds.db.Collection("usersInfo")
-	err = infoCollection.FindOne(ctx, bson.M{"user_id": userID}).Decode(&userInfo)
+}
+func (ds *DocumentStore) setInSession(username string, inSession bool) error {
+	// Quick visibility checks
+	user, err := ds.backend.findUser(username)
 	if err != nil {
-		return false // User info not found or some error occurred
+		return err
 	}
+	ds.logger.Println("No errors finding user -> ", user.Username)
+	return ds.backend.setInSession(user.ID.Hex(), inSession)
+}
 
-	inSession, ok := userInfo["inSession"].(bool)
-	if !ok {
-		return false // inSession field missing or of wrong type
+// addToUserInfo adds value to one of username's user info lists. User info is keyed by the user's ID,
+// not their name, so the user is looked up first.
+func (ds *DocumentStore) addToUserInfo(username, list, value string) error {
+	user, err := ds.backend.findUser(username)
+	if err != nil {
+		return err
 	}
-
-	return inSession
+	return ds.backend.addToUserInfo(user.ID.Hex(), list, value)
 }
 
-func (ds *DocumentStore) setInSession(username string, inSession bool) error {
-	ctx := context.Background()
-	coll := ds.db.Collection(UsersCollection)
-
-	// Quick visibility checks
-	var user bson.M
-	err := coll.FindOne(ctx, bson.M{"username": username}).Decode(&user)
+// claimSession marks username as hosting a room in one step, so two rooms can't both be handed to them.
+// It reports false if they already host one.
+func (ds *DocumentStore) claimSession(username string) (bool, error) {
+	user, err := ds.backend.findUser(username)
 	if err != nil {
-		return err
+		return false, err
 	}
-	ds.logger.Println("No errors finding user -> ", user)
-	coll = ds.db.Collection(UserInfoCollection)
-	err = coll.FindOneAndUpdate(ctx, bson.M{"user_id": user["_id"].(primitive.ObjectID).Hex()}, bson.M{"$set": bson.M{"inSession": inSession}}).Err()
-	return err
+	return ds.backend.claimSession(user.ID.Hex())
 }
-func (ds *DocumentStore) CreateRoom(hostUsername, roomName string, lifetime, maxUsers uint, public bool) (map[string]interface{}, error) {
+
+// CreateRoom opens a room for hostUsername. A zero startsAt starts the party right away, a later one
+// creates the room scheduled: guests can join and queue songs until it starts.
+func (ds *DocumentStore) CreateRoom(hostUsername, roomName string, lifetime, maxUsers uint, public bool, rules RoomRules, ordering QueueOrdering, startsAt time.Time) (CreatedRoom, error) {
 	ds.logger.Printf(
-		"CreateRoom called with hostUsername=%s, roomName=%s, lifetime=%d, maxUsers=%d, public=%t\n",
-		hostUsername, roomName, lifetime, maxUsers, public,
+		"CreateRoom called with hostUsername=%s, roomName=%s, lifetime=%d, maxUsers=%d, public=%t, rules=%+v, ordering=%+v, startsAt=%s\n",
+		hostUsername, roomName, lifetime, maxUsers, public, rules, ordering, startsAt,
 	)
-	if ds.inSession(hostUsername) {
-		ds.logger.Printf("user %s is already in a session, cannot create room\n", hostUsername)
-		return nil, ErrCannotCreateRoomAlreadyInSession
+	if ordering.Mode == "" {
+		ordering.Mode = QueueModeFIFO
 	}
-
-	ds.logger.Printf("user %s is not in a session, proceeding to create room\n", hostUsername)
-	err := ds.setInSession(hostUsername, true)
+	if lifetime == 0 || lifetime > MaxRoomLifetime {
+		return CreatedRoom{}, ErrInvalidLifetime
+	}
+	now := time.Now()
+	if startsAt.IsZero() {
+		startsAt = now
+	} else if !startsAt.After(now) || startsAt.After(now.Add(MaxScheduleAhead)) {
+		return CreatedRoom{}, ErrInvalidStartTime
+	}
+	claimed, err := ds.claimSession(hostUsername)
 	if err != nil {
 		ds.logger.Printf("failed to set user %s inSession to true: %v\n", hostUsername, err)
-		return nil, err
+		return CreatedRoom{}, err
 	}
-	roomsCollection := ds.db.Collection(RoomsCollection)
-	ctx := context.Background()
-	roomID := internal.RandomHash()
-	roomPassword := internal.RandomHash()
-	token := internal.NewJWTHandler().CreateToken(hostUsername, roomID, time.Duration(lifetime)*time.Minute)
-	_, err = roomsCollection.InsertOne(ctx, bson.M{
-		"roomID":       roomID,
-		"hostID":       hostUsername,
-		"accessToken":  token,
-		"CurrentQueue": []interface{}{},
-		"playedSongs":  []interface{}{},
-		"songCount":    0,
-		"usersJoined":  []string{hostUsername},
-		"RoomStats": bson.M{
-			"name":         roomName,
-			"lifetime":     int64(lifetime),
-			"maxUsers":     maxUsers,
-			"public":       public,
-			"createdAt":    time.Now(),
-			"roomPassword": roomPassword,
+	if !claimed {
+		ds.logger.Printf("user %s is already in a session, cannot create room\n", hostUsername)
+		return CreatedRoom{}, ErrCannotCreateRoomAlreadyInSession
+	}
+	ds.logger.Printf("user %s is not in a session, proceeding to create room\n", hostUsername)
+	version := int64(0)
+	room := Room{
+		RoomID:       internal.RandomHash(),
+		HostID:       hostUsername,
+		CurrentQueue: []QueueEntry{},
+		PlayedSongs:  []QueueEntry{},
+		Version:      &version,
+		UsersJoined:  []string{hostUsername},
+		Participants: []string{hostUsername},
+		Stats: RoomStats{
+			Name:         roomName,
+			Lifetime:     int64(lifetime),
+			MaxUsers:     int64(maxUsers),
+			Public:       public,
+			CreatedAt:    now,
+			StartsAt:     startsAt,
+			RoomPassword: internal.RandomHash(),
+			Rules:        rules,
+			Ordering:     ordering,
 		},
-	})
+	}
+	err = ds.backend.insertRoom(&room)
 	if err != nil {
 		ds.logger.Printf("Error creating room: %v\n", err)
-		return nil, err
+		if err := ds.setInSession(hostUsername, false); err != nil {
+			ds.logger.Printf("failed to set user %s inSession to false: %v\n", hostUsername, err)
+		}
+		return CreatedRoom{}, err
 	}
+	ds.touch(room.RoomID, hostUsername)
 
-	return map[string]interface{}{
-		"roomProps": map[string]interface{}{
-			"roomID":       roomID,
-			"roomPassword": roomPassword,
-			"hostID":       hostUsername,
-			"roomName":     roomName,
-			"maxUsers":     maxUsers,
-			"isPublic":     public,
-		},
-		"accessToken": map[string]interface{}{
-			"token":     token,
-			"expiresIn": time.Now().Add(time.Duration(lifetime) * time.Minute).Unix(),
-		},
-		"timeStamp": time.Now().Unix(),
+	return CreatedRoom{
+		RoomProps: roomProps(&room),
+		// the refresh token lives as long as the room, including the wait for a scheduled start
+		AccessToken: newAccessToken(hostUsername, room.RoomID, internal.RoleHost, room.TimeLeft()),
+		TimeStamp:   time.Now().Unix(),
 	}, nil
 }
 
-func (ds *DocumentStore) UpdateRoomSettings(hostUsername, roomName string, maxUsers uint, public bool) (map[string]interface{}, error) {
-	userColl := ds.db.Collection(UsersCollection)
-	ctx := context.Background()
-
-	var user bson.M
-	err := userColl.FindOne(ctx, bson.M{"username": hostUsername}).Decode(&user)
-	if err != nil {
-		return nil, fmt.Errorf("user not found")
-	}
-	roomColl := ds.db.Collection(RoomsCollection)
-	var room bson.M
-	err = roomColl.FindOne(ctx, bson.M{"hostID": hostUsername}).Decode(&room)
-	if err != nil {
-		return nil, fmt.Errorf("room not found")
-	}
-	_, err = roomColl.UpdateOne(ctx, bson.M{"hostID": hostUsername}, bson.M{
-		"$set": bson.M{
-			"RoomStats.name":     roomName,
-			"RoomStats.maxUsers": maxUsers,
-			"RoomStats.public":   public,
-		},
+// UpdateRoomSettings changes the settings of roomID, ErrNotRoomHost unless hostUsername is its host.
+// A lifetime of 0 leaves it as is, any other lifetime moves the end of the room, counted from its start,
+// and re-issues the host token to match.
+func (ds *DocumentStore) UpdateRoomSettings(roomID, hostUsername, roomName string, lifetime, maxUsers uint, public bool, rules RoomRules, ordering QueueOrdering) (UpdatedRoom, error) {
+	if ordering.Mode == "" {
+		ordering.Mode = QueueModeFIFO
+	}
+	var room *Room
+	var token *AccessToken
+	err := ds.updateRoomVersioned(roomID, func(current *Room) error {
+		token = nil
+		if current.HostID != hostUsername {
+			return ErrNotRoomHost
+		}
+		if lifetime != 0 && int64(lifetime) != current.Stats.Lifetime {
+			now := time.Now()
+			end := current.StartTime().Add(time.Duration(lifetime) * time.Minute)
+			if !end.After(now) {
+				return ErrLifetimeInPast
+			}
+			if end.Sub(maxTime(now, current.StartTime())) > MaxRoomLifetime*time.Minute {
+				return ErrInvalidLifetime
+			}
+			current.Stats.Lifetime = int64(lifetime)
+			issued := newAccessToken(hostUsername, current.RoomID, internal.RoleHost, end.Sub(now))
+			token = &issued
+		}
+		current.Stats.Name = roomName
+		current.Stats.MaxUsers = int64(maxUsers)
+		current.Stats.Public = public
+		current.Stats.Rules = rules
+		current.Stats.Ordering = ordering
+		room = current
+		return nil
 	})
 	if err != nil {
-		return nil, err
+		return UpdatedRoom{}, err
 	}
-	createdAt := room["RoomStats"].(bson.M)["createdAt"].(primitive.DateTime)
-	// Use createdAt here
-	duration := time.Since(createdAt.Time())
+	duration := time.Since(room.StartTime())
 	totalMinutes := int(duration.Minutes())
 	seconds := int(duration.Seconds()) % 60
-	ds.logger.Printf("time since createdAt: %d:%02d\n", totalMinutes, seconds)
-	ds.logger.Printf("%v\n type: %T\n", room["RoomStats"].(bson.M)["lifetime"], room["RoomStats"].(bson.M)["lifetime"])
-	originalMinutes := room["RoomStats"].(bson.M)["lifetime"].(int64)
-	difference := originalMinutes - int64(totalMinutes)
-	timeLeft := difference
-	return map[string]interface{}{
-		"roomProps": map[string]interface{}{
-			"roomID":       room["roomID"],
-			"roomPassword": room["RoomStats"].(bson.M)["roomPassword"],
-			"hostID":       hostUsername,
-			"roomName":     roomName,
-			"maxUsers":     maxUsers,
-			"isPublic":     public,
-			"timeLeft":     timeLeft,
-		},
-		"timeStamp": time.Now().Unix(),
+	ds.logger.Printf("time since start: %d:%02d\n", totalMinutes, seconds)
+
+	return UpdatedRoom{
+		RoomProps:   roomProps(room),
+		AccessToken: token,
+		TimeStamp:   time.Now().Unix(),
 	}, nil
 }
 
-func (ds *DocumentStore) DeleteRoom(accessToken, hostUsername, roomID string) (map[string]interface{}, error) {
-	RoomsCollection := ds.db.Collection(RoomsCollection)
-	ctx := context.Background()
+// newAccessToken issues username a token pair for the room whose refresh token lasts for timeLeft
+func newAccessToken(username, roomID, role string, timeLeft time.Duration) AccessToken {
+	pair := internal.NewJWTHandler().CreateTokenPair(username, roomID, role, timeLeft)
+	return AccessToken{
+		Token:            pair.AccessToken,
+		ExpiresIn:        pair.AccessExpiresAt.Unix(),
+		RefreshToken:     pair.RefreshToken,
+		RefreshExpiresIn: pair.RefreshExpiresAt.Unix(),
+	}
+}
+
+func maxTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+func roomProps(room *Room) RoomProps {
+	return RoomProps{
+		RoomID:       room.RoomID,
+		RoomPassword: room.Stats.RoomPassword,
+		HostID:       room.HostID,
+		RoomName:     room.Stats.Name,
+		MaxUsers:     room.Stats.MaxUsers,
+		IsPublic:     room.Stats.Public,
+		Rules:        room.Stats.Rules,
+		Ordering:     room.Stats.Ordering,
+		CoHosts:      coHostsOf(room),
+		Lifetime:     room.Stats.Lifetime,
+		StartsAt:     room.StartTime().Unix(),
+		Scheduled:    room.Scheduled(time.Now()),
+		TimeLeft:     int64(room.TimeLeft().Minutes()),
+	}
+}
 
-	// Verify room exists and hostUsername matches
-	var room bson.M
+// DeleteRoom ends the session of the room hostUsername is hosting, callers check the host's token
+func (ds *DocumentStore) DeleteRoom(hostUsername, roomID string) (SessionSummary, error) {
 	ds.logger.Printf("Attempting to delete room with roomID=%s by hostUsername=%s\n", roomID, hostUsername)
-	err := RoomsCollection.FindOne(ctx, bson.M{"roomID": roomID, "hostID": hostUsername}).Decode(&room)
-	if err == mongo.ErrNoDocuments {
-		return nil, ErrRoomDoesntExist
-	} else if err != nil {
+	// rooms where nothing played end too, with an empty summary
+	return ds.endSession(roomID, SessionEndedByHost, func(room *Room) error {
+		if room.HostID != hostUsername {
+			return ErrRoomDoesntExist
+		}
+		return nil
+	})
+}
+
+// endSession removes the room if check passes and closes out its session: the session is archived, the catalog
+// gets the room's plays and the host is free to start a new room. ErrRoomDoesntExist if the session was already ended.
+func (ds *DocumentStore) endSession(roomID, reason string, check func(room *Room) error) (SessionSummary, error) {
+	room, err := ds.deleteRoomVersioned(roomID, check)
+	if err != nil {
+		return SessionSummary{}, err
+	}
+	summary := ds.summarizeSession(room.PlayedSongs)
+	// nobody's tokens for the room should outlive it
+	if err := internal.RevokeRoomTokens(room.RoomID); err != nil {
+		ds.logger.Printf("failed to revoke the tokens of room %s: %v\n", room.RoomID, err)
+	}
+	participants := participantsOf(room)
+	playedSongs := room.PlayedSongs
+	if playedSongs == nil {
+		playedSongs = []QueueEntry{}
+	}
+	err = ds.backend.insertSession(&Session{
+		SessionID:    room.RoomID,
+		RoomName:     room.Stats.Name,
+		HostID:       room.HostID,
+		Participants: participants,
+		PlayedSongs:  playedSongs,
+		Summary:      summary,
+		Lifetime:     room.Stats.Lifetime,
+		StartedAt:    room.Stats.CreatedAt,
+		EndedAt:      time.Now(),
+		EndReason:    reason,
+	})
+	if err != nil {
+		ds.logger.Printf("failed to archive session %s: %v\n", room.RoomID, err)
+		// Not returning error here because room deletion was successful
+	}
+	if err := ds.recordSessionInCatalog(room.RoomID, room.PlayedSongs); err != nil {
+		ds.logger.Printf("failed to record room %s plays in the song catalog: %v\n", room.RoomID, err)
+		// Not returning error here because room deletion was successful
+	}
+	// Set host user's inSession to false
+	err = ds.setInSession(room.HostID, false)
+	if err != nil {
+		ds.logger.Printf("failed to set user %s inSession to false: %v\n", room.HostID, err)
+		// Not returning error here because room deletion was successful
+	}
+	for _, username := range participants {
+		// guests don't need an account, only registered users have a session list to add to
+		err := ds.addToUserInfo(username, userInfoPreviousSessions, room.RoomID)
+		if err == ErrUserNotFound {
+			continue
+		}
+		if err != nil {
+			ds.logger.Printf("failed to update previousSessions for user %s: %v\n", username, err)
+			// Not returning error here because room deletion was successful
+		}
+	}
+	return summary, nil
+}
+
+// GetSession returns the archive of a finished session
+func (ds *DocumentStore) GetSession(sessionID string) (Session, error) {
+	session, err := ds.backend.findSession(sessionID)
+	if err != nil {
+		return Session{}, err
+	}
+	return *session, nil
+}
+
+// UserSessions returns the finished sessions the user hosted or joined, newest first
+func (ds *DocumentStore) UserSessions(username string) ([]Session, error) {
+	found, err := ds.backend.findUserSessions(username)
+	if err != nil {
 		return nil, err
 	}
+	sessions := make([]Session, 0, len(found))
+	for _, session := range found {
+		sessions = append(sessions, *session)
+	}
+	return sessions, nil
+}
 
-	// Verify accessToken matches
-	if room["accessToken"] != accessToken {
-		return nil, fmt.Errorf("invalid access token")
+// summarizeSession hands out the end of session awards, a session where nothing played gets an empty summary
+func (ds *DocumentStore) summarizeSession(playedSongs []QueueEntry) SessionSummary {
+	if len(playedSongs) == 0 {
+		return SessionSummary{}
 	}
 	// (1) get the user with the most likes across all the songs,
 	// (2) and the user with the most likes on any given song,
 	// (3) user with most dislikes,
 	// (4) user with most disliked song
-	playedSongs := room["playedSongs"].(primitive.A)
 	userLikeCount := make(map[string]int32)    // user:like count
 	userDislikeCount := make(map[string]int32) // user:dislike count
 	MostLikedSong := make(map[string]int32)    // songID:like count
 	MostDislikedSong := make(map[string]int32) // songID:dislike count
-	SongTable := make(map[string]interface{})  // songID:song object
-	type resultStruct struct {
-		MostLikedUser    string
-		MostDislikedUser string
-		MostLikedSong    interface{}
-		MostDislikedSong interface{}
-	}
-	var result resultStruct
-	if len(playedSongs) > 0 {
-		SongEntry := playedSongs[0]
-		songMap := SongEntry.(bson.M)
-		song := songMap["song"].(bson.M)
-		metadata := song["metadata"].(bson.M)
-		//stats := song["stats"].(bson.M)
-
-		addedBy := metadata["addedBy"].(string)
-		result.MostLikedSong = addedBy
-		result.MostDislikedSong = addedBy
-		result.MostLikedSong = SongEntry
-		result.MostDislikedSong = SongEntry
-	} else {
-		return nil, ErrNoSongsPlayed
-	}
-	for _, SongEntry := range playedSongs {
-		ds.logger.Println("SongEntry -> ", SongEntry)
-
-		songMap := SongEntry.(bson.M)
-		song := songMap["song"].(bson.M)
-		metadata := song["metadata"].(bson.M)
-		stats := song["stats"].(bson.M)
-
-		// Extract the values
-		songID := song["songId"].(string)
-		likes := metadata["likes"].(int32)
-		dislikes := metadata["dislikes"].(int32)
-		addedBy := metadata["addedBy"].(string)
-
-		SongTable[songID] = SongEntry
+	SongTable := make(map[string]QueueEntry)   // songID:song object
+	for _, entry := range playedSongs {
+		song := entry.Song
+		likes := int32(song.Metadata.Likes)
+		dislikes := int32(song.Metadata.Dislikes)
+		addedBy := song.Metadata.AddedBy
+
+		SongTable[song.SongID] = entry
 		userLikeCount[addedBy] += likes
 		userDislikeCount[addedBy] += dislikes
-		MostLikedSong[songID] = likes
-		MostDislikedSong[songID] = dislikes
+		MostLikedSong[song.SongID] = likes
+		MostDislikedSong[song.SongID] = dislikes
 
-		infoString := fmt.Sprintf("%s - %s - %s", stats["artist"], stats["title"], stats["album"])
+		infoString := fmt.Sprintf("%s - %s - %s", song.Stats.Artist, song.Stats.Title, song.Stats.Album)
 		ds.logger.Printf("Artist Info string : %s\n", infoString)
-		ds.logger.Printf("\n SongID: %s, Likes: %d, Dislikes: %d, AddedBy: %s\n", songID, likes, dislikes, addedBy)
+		ds.logger.Printf("\n SongID: %s, Likes: %d, Dislikes: %d, AddedBy: %s\n", song.SongID, likes, dislikes, addedBy)
 	}
-	ds.logger.Printf(" %v, %v,%v,%v,%v\n", userLikeCount, userDislikeCount, MostLikedSong, MostDislikedSong, SongTable)
+	ds.logger.Printf(" %v, %v,%v,%v\n", userLikeCount, userDislikeCount, MostLikedSong, MostDislikedSong)
 	sortedUserLikes := toSlice(userLikeCount)
 	sortSlice(sortedUserLikes)
 	sortedUserDislikes := toSlice(userDislikeCount)
@@ -370,172 +505,208 @@ func (ds *DocumentStore) DeleteRoom(accessToken, hostUsername, roomID string) (m
 	sortSlice(mostLikedSorted)
 	mostDislikedSorted := toSlice(MostDislikedSong)
 	sortSlice(mostDislikedSorted)
-	//
-	result.MostLikedUser = sortedUserLikes[0].txt
-	result.MostDislikedUser = sortedUserDislikes[0].txt
-	result.MostLikedSong = SongTable[mostLikedSorted[0].txt]
-	result.MostDislikedSong = SongTable[mostDislikedSorted[0].txt]
 
-	err = RoomsCollection.FindOneAndDelete(ctx, bson.M{"roomID": roomID}).Err()
-	if err != nil {
-		return nil, err
+	return SessionSummary{
+		MostLikedUser: UserLikeCount{
+			Username:  sortedUserLikes[0].txt,
+			LikeCount: int(sortedUserLikes[0].sortValue),
+		},
+		MostDislikedUser: UserDislikeCount{
+			Username:     sortedUserDislikes[0].txt,
+			DislikeCount: int(sortedUserDislikes[0].sortValue),
+		},
+		MostLikedSong:    SongTable[mostLikedSorted[0].txt],
+		MostDislikedSong: SongTable[mostDislikedSorted[0].txt],
 	}
-	// Set host user's inSession to false
-	err = ds.setInSession(hostUsername, false)
+}
+
+// EndExpiredRooms ends the session of every room whose lifetime ran out by now, the same way
+// DeleteRoom does, and returns the IDs of the rooms it ended. Rooms with no songs played are ended too.
+func (ds *DocumentStore) EndExpiredRooms(now time.Time) ([]string, error) {
+	expired, err := ds.backend.findExpiredRooms(now)
 	if err != nil {
-		ds.logger.Printf("failed to set user %s inSession to false: %v\n", hostUsername, err)
-		// Not returning error here because room deletion was successful
+		return nil, err
 	}
-	userInfoColl := ds.db.Collection(UserInfoCollection)
-	err = userInfoColl.FindOneAndUpdate(ctx, bson.M{"user_id": room["hostID"]}, bson.M{
-		"$push": bson.M{"previous_sessions": roomID},
-	}).Err()
-	if err != nil {
-		ds.logger.Printf("failed to update previousSessions for user %s: %v\n", hostUsername, err)
-		// Not returning error here because room deletion was successful
+	var ended []string
+	for _, room := range expired {
+		_, err := ds.endSession(room.RoomID, SessionExpired, func(room *Room) error {
+			if now.Before(room.EndTime()) {
+				return errRoomStillRunning
+			}
+			return nil
+		})
+		if err == ErrRoomDoesntExist || err == errRoomStillRunning {
+			continue // the host ended it or extended its lifetime in the meantime
+		} else if err != nil {
+			ds.logger.Printf("failed to end expired room %s: %v\n", room.RoomID, err)
+			continue
+		}
+		ds.logger.Printf("ended room %s, its lifetime ran out\n", room.RoomID)
+		ended = append(ended, room.RoomID)
 	}
-	return map[string]interface{}{
-		"mostLikedUser": map[string]interface{}{
-			"username":   result.MostLikedUser,
-			"like Count": sortedUserLikes[0].sortValue,
-		},
-		"mostDislikedUser": map[string]interface{}{
-			"username":      result.MostDislikedUser,
-			"dislike Count": sortedUserDislikes[0].sortValue,
-		},
-		"mostLikedSong":    result.MostLikedSong,
-		"mostDislikedSong": result.MostDislikedSong,
-	}, nil
+	return ended, nil
 }
 func (ds *DocumentStore) RoomExist(roomID string) bool {
 	ds.mu.RLock()
 	defer ds.mu.RUnlock()
 
-	collection := ds.db.Collection(RoomsCollection)
-	ctx := context.Background()
-
-	count, err := collection.CountDocuments(ctx, bson.M{"roomID": roomID})
+	exists, err := ds.backend.roomExists(roomID)
 	if err != nil {
 		return false
 	}
-	return count > 0
+	return exists
 }
-func (ds *DocumentStore) AddUserToRoom(roomID, roomPassword, username string) error {
-	roomsColl := ds.db.Collection(RoomsCollection)
-	ctx := context.Background()
 
-	var room bson.M
-	err := roomsColl.FindOne(ctx, bson.M{"roomID": roomID}).Decode(&room)
-	if err == mongo.ErrNoDocuments {
-		return ErrRoomDoesntExist
-	} else if err != nil {
+// findRoom reads the room with roomID, ErrRoomDoesntExist if there isn't one
+func (ds *DocumentStore) findRoom(roomID string) (*Room, error) {
+	return ds.backend.findRoom(roomID)
+}
+
+// AddUserToRoom adds username to the room and returns how long the room has left to live.
+// The time left is also returned with ErrUserAlreadyInRoom so returning users can be handed a new token.
+func (ds *DocumentStore) AddUserToRoom(roomID, roomPassword, username string) (time.Duration, error) {
+	return ds.admitUser(roomID, username, func(room *Room) error {
+		// anyone can join a public room, the password is only checked when one is sent
+		if roomPassword == "" && !room.Stats.Public {
+			return ErrRoomIsPrivate
+		}
+		if roomPassword != "" && room.Stats.RoomPassword != roomPassword {
+			return ErrInvalidRoomPassword
+		}
+		return nil
+	}, nil)
+}
+
+// CheckRoomPassword returns ErrInvalidRoomPassword unless roomPassword is the room's password
+func (ds *DocumentStore) CheckRoomPassword(roomID, roomPassword string) error {
+	room, err := ds.findRoom(roomID)
+	if err != nil {
 		return err
 	}
-	if room["RoomStats"].(bson.M)["roomPassword"] != roomPassword {
+	if room.Stats.RoomPassword != roomPassword {
 		return ErrInvalidRoomPassword
 	}
-	// Check if user is already in the room
-	usersJoined := room["usersJoined"].(primitive.A)
-	for _, user := range usersJoined {
-		if user == username {
+	return nil
+}
+
+// admitUser adds username to the room once allowed accepts how they are getting in.
+// admitted runs in the same write, only when username wasn't in the room yet.
+func (ds *DocumentStore) admitUser(roomID, username string, allowed func(*Room) error, admitted func(*Room)) (time.Duration, error) {
+	var timeLeft time.Duration
+	err := ds.updateRoomVersioned(roomID, func(room *Room) error {
+		if err := allowed(room); err != nil {
+			return err
+		}
+		if slices.Contains(room.Banned, username) {
+			return ErrUserBanned
+		}
+		timeLeft = room.TimeLeft()
+		if timeLeft <= 0 {
+			return ErrRoomExpired
+		}
+		// Check if user is already in the room
+		if slices.Contains(room.UsersJoined, username) {
 			return ErrUserAlreadyInRoom
 		}
-	}
-	// Check if room is full
-	ds.logger.Printf("size of room is %d and maxUsers is %d\n", len(usersJoined), room["RoomStats"].(bson.M)["maxUsers"].(int64))
-	if int64(len(usersJoined)) >= room["RoomStats"].(bson.M)["maxUsers"].(int64) {
-		return ErrRoomFull
-	}
+		// Check if room is full, people who went quiet don't take up a spot
+		active := ds.activeUsers(room)
+		ds.logger.Printf("room has %d active users and maxUsers is %d\n", len(active), room.Stats.MaxUsers)
+		if int64(len(active)) >= room.Stats.MaxUsers {
+			return ErrRoomFull
+		}
 
-	// Add user to the room
-	_, err = roomsColl.UpdateOne(ctx, bson.M{"roomID": roomID}, bson.M{
-		"$push": bson.M{"usersJoined": username},
+		// Add user to the room
+		room.UsersJoined = append(room.UsersJoined, username)
+		if !slices.Contains(room.Participants, username) {
+			room.Participants = append(room.Participants, username)
+		}
+		if admitted != nil {
+			admitted(room)
+		}
+		return nil
 	})
-	if err != nil {
-		return err
+	switch err {
+	case nil, ErrUserAlreadyInRoom:
+		ds.touch(roomID, username)
+		return timeLeft, err
+	default:
+		return 0, err
 	}
-	return nil
 }
-func (ds *DocumentStore) AddSongToQueue(roomID string, song map[string]interface{}) error {
-	roomCol := ds.db.Collection(RoomsCollection)
-	ctx := context.Background()
-	var room bson.M
-	err := roomCol.FindOne(ctx, bson.M{"roomID": roomID}).Decode(&room)
+
+// AddSongToQueue appends the song to the room's queue as long as it doesn't break any of the room's rules.
+// Only the song's ID, stats and who added it are read from song, the rest is filled in here.
+func (ds *DocumentStore) AddSongToQueue(roomID string, song Song, externalID string) error {
+	now := time.Now()
+	song.Metadata = SongMetadata{
+		AddedBy:    song.Metadata.AddedBy,
+		AddedAt:    now,
+		LikedBy:    []string{},
+		DislikedBy: []string{},
+	}
+	// every add of the same track points at one catalog entry
+	song.CatalogID = CatalogID(song.Stats.Title, song.Stats.Artist, song.Stats.Album, externalID)
+
+	err := ds.updateRoomVersioned(roomID, func(room *Room) error {
+		// checked against the same read the version check protects, so parallel adds can't sneak past a limit
+		if err := checkRoomRules(room, song.Metadata.AddedBy, now); err != nil {
+			return err
+		}
+		// position comes from the same read the version check protects, so two adds can't share one
+		entry := QueueEntry{
+			Song:     song,
+			Position: room.SongCount,
+		}
+		ds.logger.Printf("Adding song to room %s queue: %+v\n", roomID, entry)
+		room.CurrentQueue = orderQueue(room, append(room.CurrentQueue, entry), now)
+		room.SongCount++
+		return nil
+	})
 	if err != nil {
 		return err
 	}
-	position := room["songCount"].(int32)
-
-	// Build the nested song structure
-	stats, _ := song["stats"].(map[string]interface{})
-	metadata := map[string]interface{}{
-		"addedBy":  stats["addedBy"],
-		"likes":    0,
-		"dislikes": 0,
-	}
-
-	songDoc := map[string]interface{}{
-		"song": map[string]interface{}{
-			"songId": song["songID"],
-			"stats": map[string]interface{}{
-				"title":  stats["songName"],
-				"artist": stats["artistName"],
-				"album":  stats["albumName"],
-				// "duration": // add if available
-			},
-			"metadata": metadata,
-		},
-		"alreadyPlayed": false,
-		"position":      position,
+	// only songs that made it into a queue get a catalog entry. The song is queued either way,
+	// failing here would only make the caller add it twice, so a missing entry just loses its stats
+	if _, err := ds.UpsertCatalogSong(song.Stats.Title, song.Stats.Artist, song.Stats.Album, externalID); err != nil {
+		ds.logger.Printf("failed to add song %s to the catalog: %v\n", song.CatalogID, err)
 	}
-
-	ds.logger.Printf("Adding song to room %s queue: %+v\n", roomID, songDoc)
-	_, err = roomCol.UpdateOne(ctx, bson.M{"roomID": roomID}, bson.M{
-		"$push": bson.M{"CurrentQueue": songDoc},
-		"$inc":  bson.M{"songCount": 1},
-	})
-	return err
+	return nil
 }
-func (ds *DocumentStore) GetCurrentQueue(roomID string) (primitive.A, error) {
-	roomCol := ds.db.Collection(RoomsCollection)
-	ctx := context.Background()
-
-	var room bson.M
-	err := roomCol.FindOne(ctx, bson.M{"roomID": roomID}).Decode(&room)
+func (ds *DocumentStore) GetCurrentQueue(roomID string) ([]QueueEntry, error) {
+	room, err := ds.findRoom(roomID)
 	if err != nil {
 		return nil, err
 	}
-
-	currentQueue := room["CurrentQueue"].(primitive.A)
-	return currentQueue, nil
+	return room.CurrentQueue, nil
 }
 
-func (ds *DocumentStore) UpdateQueue(roomID string, newQueue []string) ([]interface{}, error) {
-	roomColl := ds.db.Collection(RoomsCollection)
-	ctx := context.Background()
-
-	var room bson.M
-	err := roomColl.FindOne(ctx, bson.M{"roomID": roomID}).Decode(&room)
-	if err != nil {
-		return nil, err
-	}
+func (ds *DocumentStore) UpdateQueue(roomID string, newQueue []string) ([]QueueEntry, error) {
 	var temporder = make(map[string]int)
 	for index, songId := range newQueue {
 		temporder[songId] = index
 	}
 
-	currentQueue := room["CurrentQueue"].(primitive.A)
-	var newOrderQueue = make([]interface{}, len(newQueue))
-	for _, songMap := range currentQueue {
-		songId := songMap.(primitive.M)["song"].(primitive.M)["songId"].(string)
-		pos := temporder[songId]
-		newOrderQueue[pos] = songMap
-	}
-
-	// Create a map from songId to song object for fast lookup
-	// Update the database with the new ordered queue
-	_, err = roomColl.UpdateOne(ctx, bson.M{"roomID": roomID}, bson.M{
-		"$set": bson.M{"CurrentQueue": newOrderQueue},
+	var newOrderQueue []QueueEntry
+	err := ds.updateRoomVersioned(roomID, func(room *Room) error {
+		currentQueue := room.CurrentQueue
+		// the new order has to mention every queued song exactly once, otherwise songs would be dropped or duplicated
+		if len(newQueue) != len(currentQueue) || len(temporder) != len(newQueue) {
+			return ErrInvalidQueueOrder
+		}
+		newOrderQueue = make([]QueueEntry, len(newQueue))
+		for _, entry := range currentQueue {
+			pos, ok := temporder[entry.Song.SongID]
+			if !ok {
+				return ErrInvalidQueueOrder
+			}
+			newOrderQueue[pos] = entry
+		}
+		// whatever the host moved stays put when the queue mode reorders the rest
+		pinMovedSongs(currentQueue, newOrderQueue)
+		newOrderQueue = orderQueue(room, newOrderQueue, time.Now())
+		// Update the database with the new ordered queue
+		room.CurrentQueue = newOrderQueue
+		return nil
 	})
 	if err != nil {
 		return nil, err
@@ -552,335 +723,397 @@ var validOperations = map[string]bool{
 	"un-dislike": true,
 }
 
-func (ds *DocumentStore) SongOperation(roomID, songID, userID, operation string) error {
-	roomCol := ds.db.Collection(RoomsCollection)
-	ctx := context.Background()
-
-	var room bson.M
-	err := roomCol.FindOne(ctx, bson.M{"roomID": roomID}).Decode(&room)
-	if err != nil {
-		return err
+// SongVoteEvent is the event published when operation changed a vote
+func SongVoteEvent(operation string) events.Type {
+	switch operation {
+	case "like":
+		return events.SongLiked
+	case "dislike":
+		return events.SongDisliked
+	case "un-like":
+		return events.SongUnliked
+	case "un-dislike":
+		return events.SongUndisliked
 	}
+	return ""
+}
+
+// SongVote is a user's vote on a song after a SongOperation along with the song's new totals
+type SongVote struct {
+	SongID   string `json:"songID"`
+	MyVote   string `json:"myVote"` // like, dislike or empty when the user has no vote on the song
+	Likes    int    `json:"likes"`
+	Dislikes int    `json:"dislikes"`
+	Changed  bool   `json:"-"`
+}
+
+// SongOperation applies a like/dislike to a song in the queue. Each song keeps the set of users who liked and disliked it,
+// so voting is idempotent, a like replaces a dislike (and the other way around) and the counts always match the sets.
+// When the room orders its queue by votes the upcoming songs are reordered with the new score, the new order is returned if anything moved.
+func (ds *DocumentStore) SongOperation(roomID, songID, userID, operation string) (SongVote, []string, error) {
 	if !validOperations[operation] {
-		return ErrInvalidSongOperation(operation)
+		return SongVote{}, nil, fmt.Errorf("[%s] %w", operation, ErrInvalidSongOperation)
 	}
 	ds.logger.Printf("%s is Performing operation '%s' on songs in room '%s'\n", userID, operation, roomID)
-	// dont want the this holding up the main operation
-	if userID == room["hostID"] {
-		go func() {
-			userInfoColl := ds.db.Collection(UserInfoCollection)
-			if operation == "like" {
-				_, err := userInfoColl.UpdateOne(ctx, bson.M{"userID": userID}, bson.M{"$addToSet": bson.M{"liked_songs": songID}})
-				if err != nil {
-					ds.logger.Printf("Failed to update user info for %s: %v\n", userID, err)
-				}
-			}
-			if operation == "dislike" {
-				_, err := userInfoColl.UpdateOne(ctx, bson.M{"userID": userID}, bson.M{"$addToSet": bson.M{"disliked_songs": songID}})
-				if err != nil {
-					ds.logger.Printf("Failed to update user info for %s: %v\n", userID, err)
-				}
-			}
-		}()
 
+	var vote SongVote
+	var newOrder []string
+	var hostID string
+	err := ds.updateRoomVersioned(roomID, func(room *Room) error {
+		hostID = room.HostID
+		index := slices.IndexFunc(room.CurrentQueue, func(entry QueueEntry) bool { return entry.Song.SongID == songID })
+		if index == -1 {
+			return ErrSongNotInQueue
+		}
+		metadata := &room.CurrentQueue[index].Song.Metadata
+		before := songVoteState(*metadata, userID)
+		switch operation {
+		case "like":
+			metadata.LikedBy = addVoter(metadata.LikedBy, userID)
+			metadata.DislikedBy = removeVoter(metadata.DislikedBy, userID)
+		case "dislike":
+			metadata.DislikedBy = addVoter(metadata.DislikedBy, userID)
+			metadata.LikedBy = removeVoter(metadata.LikedBy, userID)
+		case "un-like":
+			metadata.LikedBy = removeVoter(metadata.LikedBy, userID)
+		case "un-dislike":
+			metadata.DislikedBy = removeVoter(metadata.DislikedBy, userID)
+		}
+		metadata.Likes, metadata.Dislikes = len(metadata.LikedBy), len(metadata.DislikedBy)
+
+		vote = SongVote{
+			SongID:   songID,
+			MyVote:   songVoteState(*metadata, userID),
+			Likes:    metadata.Likes,
+			Dislikes: metadata.Dislikes,
+		}
+		vote.Changed = vote.MyVote != before
+		if !vote.Changed {
+			return errNoVoteChange
+		}
+
+		reordered := orderQueue(room, room.CurrentQueue, time.Now())
+		newOrder = nil
+		if before, after := queueSongIDs(room.CurrentQueue), queueSongIDs(reordered); !slices.Equal(before, after) {
+			newOrder = after
+		}
+		room.CurrentQueue = reordered
+		return nil
+	})
+	if err == errNoVoteChange {
+		// voting the same way twice is not an error, there is just nothing to write
+		return vote, nil, nil
 	}
-	switch operation {
-	case "like":
-		_, err = roomCol.UpdateOne(ctx,
-			bson.M{
-				"roomID":                   roomID,
-				"CurrentQueue.song.songId": songID,
-			},
-			bson.M{"$inc": bson.M{"CurrentQueue.$.song.metadata.likes": 1}},
-		)
-		return err
-	case "dislike":
-		_, err = roomCol.UpdateOne(ctx,
-			bson.M{
-				"roomID":                   roomID,
-				"CurrentQueue.song.songId": songID,
-			},
-			bson.M{"$inc": bson.M{"CurrentQueue.$.song.metadata.dislikes": 1}},
-		)
-		return err
-	case "un-like":
-		_, err = roomCol.UpdateOne(ctx,
-			bson.M{
-				"roomID":                   roomID,
-				"CurrentQueue.song.songId": songID,
-			},
-			bson.M{"$inc": bson.M{"CurrentQueue.$.song.metadata.likes": -1}},
-		)
-		return err
-	case "un-dislike":
-		_, err = roomCol.UpdateOne(ctx,
-			bson.M{
-				"roomID":                   roomID,
-				"CurrentQueue.song.songId": songID,
-			},
-			bson.M{"$inc": bson.M{"CurrentQueue.$.song.metadata.dislikes": -1}},
-		)
-		return err
+	if err != nil {
+		return SongVote{}, nil, err
+	}
+
+	// the host keeps a list of the songs they liked and disliked, the vote already counts if that fails
+	if userID == hostID {
+		list := ""
+		switch operation {
+		case "like":
+			list = userInfoLikedSongs
+		case "dislike":
+			list = userInfoDislikedSongs
+		}
+		if list != "" {
+			if err := ds.addToUserInfo(userID, list, songID); err != nil {
+				ds.logger.Printf("Failed to update user info for %s: %v\n", userID, err)
+			}
+		}
+	}
+	return vote, newOrder, nil
+}
+
+// errNoVoteChange stops updateRoomVersioned from writing when a vote leaves the song as it was
+var errNoVoteChange = fmt.Errorf("vote didn't change")
+
+// songVoteState is how username voted on the song with this metadata
+func songVoteState(metadata SongMetadata, username string) string {
+	switch {
+	case slices.Contains(metadata.LikedBy, username):
+		return "like"
+	case slices.Contains(metadata.DislikedBy, username):
+		return "dislike"
 	default:
-		return ErrInvalidSongOperation(operation)
+		return ""
 	}
+}
 
+// MarkMyVotes sets MyVote on every song in the queue to how username voted on it
+func MarkMyVotes(queue []QueueEntry, username string) {
+	for i := range queue {
+		queue[i].MyVote = songVoteState(queue[i].Song.Metadata, username)
+	}
 }
 
-// Most Liked songs, Most disliked songs, User with most likes/dislikes, room size , queue legth
-// if no one has any likes there will be no userwith most likes/dislikes. only for likes/dislikes > 0
-func (ds *DocumentStore) RoomMetrics(roomID string) (bson.M, error) {
-	roomCol := ds.db.Collection(RoomsCollection)
-	ctx := context.Background()
+func addVoter(voters []string, username string) []string {
+	if slices.Contains(voters, username) {
+		return voters
+	}
+	return append(voters, username)
+}
 
-	var room bson.M
-	err := roomCol.FindOne(ctx, bson.M{"roomID": roomID}).Decode(&room)
-	if err != nil {
-		return nil, err
+func removeVoter(voters []string, username string) []string {
+	if voters == nil {
+		return []string{}
 	}
+	return slices.DeleteFunc(voters, func(voter string) bool { return voter == username })
+}
 
-	currentQueue := room["CurrentQueue"].(primitive.A)
-	// Track songs and user statistics
-	type SongMetric struct {
-		Song     interface{}
-		Likes    int32
-		Dislikes int32
+func queueSongIDs(queue []QueueEntry) []string {
+	ids := make([]string, 0, len(queue))
+	for _, entry := range queue {
+		ids = append(ids, entry.Song.SongID)
 	}
+	return ids
+}
 
-	var songs []SongMetric
-	userLikes := make(map[string]int32)
-	userDislikes := make(map[string]int32)
+// Most Liked songs, Most disliked songs, User with most likes/dislikes, room size , queue legth
+// if no one has any likes there will be no userwith most likes/dislikes. only for likes/dislikes > 0
+func (ds *DocumentStore) RoomMetrics(roomID string) (RoomMetricsSnapshot, error) {
+	room, err := ds.findRoom(roomID)
+	if err != nil {
+		return RoomMetricsSnapshot{}, err
+	}
 
+	userLikes := make(map[string]int)
+	userDislikes := make(map[string]int)
 	// Process each song in the queue
-	for _, songItem := range currentQueue {
-		songMap := songItem.(primitive.M)
-		song := songMap["song"].(primitive.M)
-		metadata := song["metadata"].(primitive.M)
-		// Extract likes, dislikes, and addedBy
-		likes := metadata["likes"].(int32)
-		dislikes := metadata["dislikes"].(int32)
-		addedBy := metadata["addedBy"].(string)
-
-		songs = append(songs, SongMetric{
-			Song:     songItem,
-			Likes:    likes,
-			Dislikes: dislikes,
-		})
-
+	songs := slices.Clone(room.CurrentQueue)
+	for _, entry := range songs {
 		// Accumulate user statistics
-		if addedBy != "" {
-			userLikes[addedBy] += likes
-			userDislikes[addedBy] += dislikes
+		if addedBy := entry.Song.Metadata.AddedBy; addedBy != "" {
+			userLikes[addedBy] += entry.Song.Metadata.Likes
+			userDislikes[addedBy] += entry.Song.Metadata.Dislikes
 		}
 	}
 
 	// Sort songs by likes (descending)
 	sort.Slice(songs, func(i, j int) bool {
-		return songs[i].Likes > songs[j].Likes
+		return songs[i].Song.Metadata.Likes > songs[j].Song.Metadata.Likes
 	})
-
-	mostLikedSongs := make([]interface{}, 0)
-	for i, song := range songs {
-		if i >= 5 { // top 5 or stop if we exceed queue length
-			break
-		}
-		mostLikedSongs = append(mostLikedSongs, song.Song)
-	}
+	// top 5 or stop if we exceed queue length
+	mostLikedSongs := slices.Clone(songs[:min(5, len(songs))])
 
 	// Sort songs by dislikes (descending)
 	sort.Slice(songs, func(i, j int) bool {
-		return songs[i].Dislikes > songs[j].Dislikes
+		return songs[i].Song.Metadata.Dislikes > songs[j].Song.Metadata.Dislikes
 	})
+	mostDislikedSongs := slices.Clone(songs[:min(5, len(songs))])
+
+	return RoomMetricsSnapshot{
+		MostLikedSongs:       mostLikedSongs,
+		MostDislikedSongs:    mostDislikedSongs,
+		UserWithMostLikes:    topUsers(userLikes),
+		UserWithMostDislikes: topUsers(userDislikes),
+		RoomSize:             len(room.UsersJoined),
+		ActiveUsers:          len(ds.activeUsers(room)),
+		TotalParticipants:    len(participantsOf(room)),
+		QueueLength:          len(room.CurrentQueue),
+	}, nil
+}
 
-	mostDislikedSongs := make([]interface{}, 0)
-	for i, song := range songs {
-		if i >= 5 { // Top 5 or stop if we exceed queue length
-			break
-		}
-		mostDislikedSongs = append(mostDislikedSongs, song.Song)
-	}
-
-	// Find user with most likes
-	userWithMostLikes := ""
-	maxLikes := int32(0)
-	var tiedUsersLikes []string
-	for user, likes := range userLikes {
-		if likes > maxLikes {
-			maxLikes = likes
-			tiedUsersLikes = []string{user}
-		} else if likes == maxLikes && likes > 0 {
-			tiedUsersLikes = append(tiedUsersLikes, user)
-		}
-	}
-	userWithMostLikes = strings.Join(tiedUsersLikes, ", ")
-
-	// Find user with most dislikes
-	userWithMostDislikes := ""
-	maxDislikes := int32(0)
-	var tiedUsersDislikes []string
-	for user, dislikes := range userDislikes {
-		if dislikes > maxDislikes {
-			maxDislikes = dislikes
-			tiedUsersDislikes = []string{user}
-		} else if dislikes == maxDislikes && dislikes > 0 {
-			tiedUsersDislikes = append(tiedUsersDislikes, user)
+// topUsers joins the users tied for the highest count, nobody if every count is 0
+func topUsers(counts map[string]int) string {
+	maxCount := 0
+	var tied []string
+	for user, count := range counts {
+		if count > maxCount {
+			maxCount = count
+			tied = []string{user}
+		} else if count == maxCount && count > 0 {
+			tied = append(tied, user)
 		}
 	}
-	userWithMostDislikes = strings.Join(tiedUsersDislikes, ", ")
-
-	var result = map[string]interface{}{
-		"mostLikedSongs":       mostLikedSongs,
-		"mostDislikedSongs":    mostDislikedSongs,
-		"userWithMostLikes":    userWithMostLikes,
-		"userWithMostDislikes": userWithMostDislikes,
-		"roomSize":             len(room["usersJoined"].(primitive.A)),
-		"queueLength":          len(room["CurrentQueue"].(primitive.A)),
-	}
-	return result, nil
+	return strings.Join(tied, ", ")
 }
 
-func (ds *DocumentStore) QueueHistory(roomID string) (primitive.A, error) {
-	roomCol := ds.db.Collection(RoomsCollection)
-	ctx := context.Background()
-
-	var room bson.M
-	err := roomCol.FindOne(ctx, bson.M{"roomID": roomID}).Decode(&room)
+func (ds *DocumentStore) QueueHistory(roomID string) ([]QueueEntry, error) {
+	room, err := ds.findRoom(roomID)
 	if err != nil {
 		return nil, err
 	}
-
-	history := room["playedSongs"].(primitive.A)
-	return history, nil
+	return room.PlayedSongs, nil
 }
 
-func (ds *DocumentStore) GetRoomsPlaylist(roomID string) ([]interface{}, []interface{}, error) {
-	roomCol := ds.db.Collection(RoomsCollection)
-	ctx := context.Background()
-	type SongWithLikes struct {
-		Song  interface{}
-		Likes int
-	}
-
-	var room bson.M
-	err := roomCol.FindOne(ctx, bson.M{"roomID": roomID}).Decode(&room)
+// GetRoomsPlaylist returns the songs played in the room sorted by likes and in the order they were played
+func (ds *DocumentStore) GetRoomsPlaylist(roomID string) ([]QueueEntry, []QueueEntry, error) {
+	room, err := ds.findRoom(roomID)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	currentQueue := room["playedSongs"].(primitive.A)
-	var songsWithLikes []SongWithLikes
-	for _, songMap := range currentQueue {
-		if songMap == nil {
-			continue
-		}
-
-		songPrimitive, ok := songMap.(primitive.M)
-		if !ok {
-			continue
-		}
-
-		// Safely extract likes count
-		likes := 0
-		if song, ok := songPrimitive["song"].(primitive.M); ok {
-			if metadata, ok := song["metadata"].(primitive.M); ok {
-				if likesField, ok := metadata["likes"]; ok {
-					if likesInt, ok := likesField.(int32); ok {
-						likes = int(likesInt)
-					} else if likesInt, ok := likesField.(int); ok {
-						likes = likesInt
-					}
-				}
-			}
-		}
-
-		songsWithLikes = append(songsWithLikes, SongWithLikes{
-			Song:  songMap,
-			Likes: likes,
-		})
-	}
-
 	// Sort by likes (descending order)
-	sort.Slice(songsWithLikes, func(i, j int) bool {
-		return songsWithLikes[i].Likes > songsWithLikes[j].Likes
+	sortedQueue := slices.Clone(room.PlayedSongs)
+	sort.Slice(sortedQueue, func(i, j int) bool {
+		return sortedQueue[i].Song.Metadata.Likes > sortedQueue[j].Song.Metadata.Likes
 	})
-	// Sort by likes (descending order)
-
-	// Extract sorted songs
-	sortedQueue := make([]interface{}, len(songsWithLikes))
-	for i, item := range songsWithLikes {
-		sortedQueue[i] = item.Song
-	}
-
-	return sortedQueue, currentQueue, nil
+	return sortedQueue, room.PlayedSongs, nil
 }
-func (ds *DocumentStore) RoomState(roomID string) (map[string]interface{}, error) {
-	roomColl := ds.db.Collection(RoomsCollection)
-	ctx := context.Background()
-
-	var room bson.M
-	err := roomColl.FindOne(ctx, bson.M{"roomID": roomID}).Decode(&room)
+func (ds *DocumentStore) RoomState(roomID string) (RoomSnapshot, error) {
+	room, err := ds.findRoom(roomID)
 	if err != nil {
-		return nil, err
+		return RoomSnapshot{}, err
 	}
 	// get the song current playing
-	currentQ := room["CurrentQueue"].(primitive.A)
-	var currentSong interface{}
+	currentQ := room.CurrentQueue
+	var currentSong *QueueEntry
 	if len(currentQ) > 0 {
-		currentSong = currentQ[0]
-	} else {
-		currentSong = nil
+		currentSong = &currentQ[0]
 	}
 	if len(currentQ) <= 1 {
-		currentQ = []interface{}{}
-	}
-	return map[string]interface{}{
-		"roomID":        roomID,
-		"currentSong":   currentSong,
-		"queue":         currentQ, // Exclude the currently playing song
-		"numberOfUsers": len(room["usersJoined"].(primitive.A)),
-		"RoomSettings":  room["RoomStats"],
+		currentQ = []QueueEntry{}
+	}
+	return RoomSnapshot{
+		RoomID:        roomID,
+		CurrentSong:   currentSong,
+		Queue:         currentQ,
+		NumberOfUsers: len(ds.activeUsers(room)),
+		HostID:        room.HostID,
+		CoHosts:       coHostsOf(room),
+		Scheduled:     room.Scheduled(time.Now()),
+		RoomSettings:  settingsOf(room.Stats),
 	}, nil
 }
 
-func (ds *DocumentStore) NextSong(roomID string) error {
-	roomCol := ds.db.Collection(RoomsCollection)
-	ctx := context.Background()
-
-	// Find the room
-	var room bson.M
-	err := roomCol.FindOne(ctx, bson.M{"roomID": roomID}).Decode(&room)
+// NextSong moves the song at the head of the queue into the room's history in a single write.
+// It returns the ID of the song that was just played and the ID of the song now playing, if any.
+func (ds *DocumentStore) NextSong(roomID string) (string, string, error) {
+	var playedSongID, nowPlayingSongID string
+	err := ds.updateRoomVersioned(roomID, func(room *Room) error {
+		if room.Scheduled(time.Now()) {
+			return ErrRoomNotStarted
+		}
+		played, nowPlaying, err := advanceQueue(room, false)
+		playedSongID, nowPlayingSongID = played, nowPlaying
+		return err
+	})
 	if err != nil {
+		return "", "", err
+	}
+	return playedSongID, nowPlayingSongID, nil
+}
+
+// SkipVote is where a vote to skip the current song left things
+type SkipVote struct {
+	SongID           string `json:"songID"`
+	Votes            int    `json:"votes"`
+	Needed           int    `json:"needed"`
+	Skipped          bool   `json:"skipped"`
+	NowPlayingSongID string `json:"nowPlayingSongID,omitempty"`
+}
+
+// VoteToSkip records username's vote to skip the song that is playing. Once enough of the room has voted, or the
+// user who added the song votes, the queue advances the same way NextSong does and the song is flagged as skipped.
+func (ds *DocumentStore) VoteToSkip(roomID, username string) (SkipVote, error) {
+	var result SkipVote
+	err := ds.updateRoomVersioned(roomID, func(room *Room) error {
+		if room.Scheduled(time.Now()) {
+			return ErrRoomNotStarted
+		}
+		if len(room.CurrentQueue) == 0 {
+			return ErrQueueIsEmpty
+		}
+		nowPlaying := &room.CurrentQueue[0]
+		if slices.Contains(nowPlaying.SkipVotes, username) {
+			return ErrAlreadyVotedToSkip
+		}
+		nowPlaying.SkipVotes = append(nowPlaying.SkipVotes, username)
+
+		result = SkipVote{
+			SongID: nowPlaying.Song.SongID,
+			Votes:  len(nowPlaying.SkipVotes),
+			Needed: skipVotesNeeded(room.Stats.Rules, len(ds.activeUsers(room))),
+		}
+		if result.Votes < result.Needed && nowPlaying.Song.Metadata.AddedBy != username {
+			return nil
+		}
+		_, nowPlayingSongID, err := advanceQueue(room, true)
+		result.Skipped = true
+		result.NowPlayingSongID = nowPlayingSongID
 		return err
+	})
+	if err != nil {
+		return SkipVote{}, err
 	}
+	return result, nil
+}
 
+// advanceQueue moves the head of the queue into playedSongs and reorders what is left
+func advanceQueue(room *Room, skipped bool) (playedSongID, nowPlayingSongID string, err error) {
 	// Get the current queue
-	currentQ := room["CurrentQueue"].(primitive.A)
+	currentQ := room.CurrentQueue
 	if len(currentQ) == 0 {
-		return ErrQueueIsEmpty
+		return "", "", ErrQueueIsEmpty
 	}
 
 	// Move the first song to the played songs
 	playedSong := currentQ[0]
-	if len(currentQ) >= 2 {
-		currentQ = currentQ[1:]
-	} else {
-		currentQ = []interface{}{}
-	}
+	currentQ = currentQ[1:]
 
 	// Mark the song as already played
-	playedSong.(primitive.M)["alreadyPlayed"] = true
+	now := time.Now()
+	playedSong.AlreadyPlayed = true
+	playedSong.PlayedAt = now
+	playedSong.Skipped = skipped
 
-	// Update the room
-	_, err = roomCol.UpdateOne(ctx, bson.M{"roomID": roomID}, bson.M{"$set": bson.M{"CurrentQueue": currentQ}})
-	if err != nil {
-		return err
+	// the upcoming songs are reordered with the song that just played counted as played
+	room.PlayedSongs = append(room.PlayedSongs, playedSong)
+	room.CurrentQueue = orderQueue(room, currentQ, now)
+
+	playedSongID = playedSong.Song.SongID
+	if len(room.CurrentQueue) > 0 {
+		nowPlayingSongID = room.CurrentQueue[0].Song.SongID
 	}
+	return playedSongID, nowPlayingSongID, nil
+}
 
-	// Add the played song to the played songs
-	_, err = roomCol.UpdateOne(ctx, bson.M{"roomID": roomID}, bson.M{"$push": bson.M{"playedSongs": playedSong}})
-	if err != nil {
-		return err
+// updateRoomVersioned reads the room, lets mutate change it and writes it back only if nobody else has
+// written to the room since it was read. On a conflict it starts over from a fresh read,
+// so concurrent changes can neither overwrite each other nor lose songs.
+func (ds *DocumentStore) updateRoomVersioned(roomID string, mutate func(room *Room) error) error {
+	for attempt := 1; attempt <= maxVersionedRetries; attempt++ {
+		room, err := ds.backend.findRoom(roomID)
+		if err != nil {
+			return err
+		}
+		if err := mutate(room); err != nil {
+			return err
+		}
+		written, err := ds.backend.replaceRoom(room)
+		if err != nil {
+			return err
+		}
+		if written {
+			return nil
+		}
+		ds.logger.Printf("room %s was modified concurrently, retrying update (attempt %d)\n", roomID, attempt)
 	}
+	return ErrConcurrentRoomUpdate
+}
 
-	return nil
+// deleteRoomVersioned is updateRoomVersioned for removing a room: it is deleted only if nobody wrote it since
+// it was read and passed check, otherwise it is read and checked again. The room that was deleted is returned
+// so the session is archived exactly as it ended.
+func (ds *DocumentStore) deleteRoomVersioned(roomID string, check func(room *Room) error) (*Room, error) {
+	for attempt := 1; attempt <= maxVersionedRetries; attempt++ {
+		room, err := ds.backend.findRoom(roomID)
+		if err != nil {
+			return nil, err
+		}
+		if err := check(room); err != nil {
+			return nil, err
+		}
+		deleted, err := ds.backend.deleteRoom(room)
+		if err != nil {
+			return nil, err
+		}
+		if deleted {
+			return room, nil
+		}
+		ds.logger.Printf("room %s was modified concurrently, retrying delete (attempt %d)\n", roomID, attempt)
+	}
+	return nil, ErrConcurrentRoomUpdate
 }
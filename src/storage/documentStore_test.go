@@ -0,0 +1,480 @@
+package storage
+
+import (
+	"BeatBus/events"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	// tokens are signed while rooms are created, the config has to load
+	os.Setenv("PORT", "0")
+	os.Setenv("JWT_SECRET", "test-secret")
+	os.Setenv("OUTPUT_FILE_NAME", os.DevNull)
+	os.Exit(m.Run())
+}
+
+func newTestStore(t *testing.T) (*DocumentStore, string) {
+	t.Helper()
+	ds := NewMemoryDocumentStore(log.New(io.Discard, "", 0))
+	if err := ds.InsertNewUser("host", "password"); err != nil {
+		t.Fatalf("InsertNewUser: %v", err)
+	}
+	created, err := ds.CreateRoom("host", "test room", 60, 50, false, RoomRules{}, QueueOrdering{}, time.Time{})
+	if err != nil {
+		t.Fatalf("CreateRoom: %v", err)
+	}
+	return ds, created.RoomProps.RoomID
+}
+
+func testSong(id string) Song {
+	return Song{
+		SongID:   id,
+		Stats:    SongStats{Title: "title " + id, Artist: "artist", Album: "album"},
+		Metadata: SongMetadata{AddedBy: "user-" + id},
+	}
+}
+
+// every add, next and reorder below races the others, afterwards each song that was added
+// has to be either in the queue or played, exactly once
+func TestConcurrentQueueMutations(t *testing.T) {
+	ds, roomID := newTestStore(t)
+	const adds, nexts, reorders = 60, 30, 30
+
+	var mu sync.Mutex
+	added := map[string]bool{}
+	played := []string{}
+	var wg sync.WaitGroup
+	for i := range adds {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			id := fmt.Sprintf("song-%d", i)
+			err := ds.AddSongToQueue(roomID, testSong(id), "")
+			if err == ErrConcurrentRoomUpdate {
+				return // gave up after too many conflicts, nothing was written
+			}
+			if err != nil {
+				t.Errorf("AddSongToQueue(%s): %v", id, err)
+				return
+			}
+			mu.Lock()
+			added[id] = true
+			mu.Unlock()
+		}()
+	}
+	for range nexts {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			playedID, _, err := ds.NextSong(roomID)
+			if err == ErrQueueIsEmpty || err == ErrConcurrentRoomUpdate {
+				return
+			}
+			if err != nil {
+				t.Errorf("NextSong: %v", err)
+				return
+			}
+			mu.Lock()
+			played = append(played, playedID)
+			mu.Unlock()
+		}()
+	}
+	for range reorders {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			queue, err := ds.GetCurrentQueue(roomID)
+			if err != nil {
+				t.Errorf("GetCurrentQueue: %v", err)
+				return
+			}
+			order := []string{}
+			for _, entry := range queue {
+				order = append(order, entry.Song.SongID)
+			}
+			slices.Reverse(order)
+			// the queue may have changed since it was read, that order is then rejected as a whole
+			_, err = ds.UpdateQueue(roomID, order)
+			if err != nil && err != ErrInvalidQueueOrder && err != ErrConcurrentRoomUpdate {
+				t.Errorf("UpdateQueue: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	t.Logf("%d songs added, %d played", len(added), len(played))
+
+	room, err := ds.findRoom(roomID)
+	if err != nil {
+		t.Fatalf("findRoom: %v", err)
+	}
+	seen := map[string]int{}
+	for _, entry := range append(room.CurrentQueue, room.PlayedSongs...) {
+		seen[entry.Song.SongID]++
+	}
+	for id, count := range seen {
+		if count != 1 {
+			t.Errorf("%s is in the room %d times", id, count)
+		}
+		if !added[id] {
+			t.Errorf("%s is in the room but was never added", id)
+		}
+	}
+	for id := range added {
+		if seen[id] == 0 {
+			t.Errorf("%s was added but is lost", id)
+		}
+	}
+
+	playedInRoom := []string{}
+	for _, entry := range room.PlayedSongs {
+		playedInRoom = append(playedInRoom, entry.Song.SongID)
+	}
+	slices.Sort(played)
+	slices.Sort(playedInRoom)
+	if !slices.Equal(played, playedInRoom) {
+		t.Errorf("NextSong reported playing %v but the room played %v", played, playedInRoom)
+	}
+	if int(room.SongCount) != len(added) {
+		t.Errorf("SongCount is %d, want %d", room.SongCount, len(added))
+	}
+}
+
+// conflictingBackend loses every versioned write, as if someone else always got there first
+type conflictingBackend struct {
+	*memoryBackend
+}
+
+func (cb conflictingBackend) replaceRoom(room *Room) (bool, error) {
+	return false, nil
+}
+
+func TestUpdateRoomVersionedGivesUp(t *testing.T) {
+	ds, roomID := newTestStore(t)
+	ds.backend = conflictingBackend{ds.backend.(*memoryBackend)}
+
+	attempts := 0
+	err := ds.updateRoomVersioned(roomID, func(room *Room) error {
+		attempts++
+		room.SongCount++
+		return nil
+	})
+	if err != ErrConcurrentRoomUpdate {
+		t.Fatalf("updateRoomVersioned returned %v, want ErrConcurrentRoomUpdate", err)
+	}
+	if attempts != maxVersionedRetries {
+		t.Errorf("mutate ran %d times, want %d", attempts, maxVersionedRetries)
+	}
+	room, err := ds.findRoom(roomID)
+	if err != nil {
+		t.Fatalf("findRoom: %v", err)
+	}
+	if room.SongCount != 0 {
+		t.Errorf("SongCount is %d after a failed update, want 0", room.SongCount)
+	}
+}
+
+func TestPublicRoomsPages(t *testing.T) {
+	ds := NewMemoryDocumentStore(log.New(io.Discard, "", 0))
+	createRoom := func(name string, public bool) CreatedRoom {
+		t.Helper()
+		// a user hosts one room at a time
+		if err := ds.InsertNewUser("host-"+name, "password"); err != nil {
+			t.Fatalf("InsertNewUser: %v", err)
+		}
+		created, err := ds.CreateRoom("host-"+name, name, 60, 50, public, RoomRules{}, QueueOrdering{}, time.Time{})
+		if err != nil {
+			t.Fatalf("CreateRoom: %v", err)
+		}
+		return created
+	}
+	// the first rooms get the most guests, so popular lists them in the opposite order to newest
+	const rooms = 5
+	for i := range rooms {
+		created := createRoom(fmt.Sprintf("room-%d", i), true)
+		for guest := range rooms - i {
+			if _, err := ds.AddUserToRoom(created.RoomProps.RoomID, created.RoomProps.RoomPassword, fmt.Sprintf("guest-%d", guest)); err != nil {
+				t.Fatalf("AddUserToRoom: %v", err)
+			}
+		}
+		if err := ds.AddSongToQueue(created.RoomProps.RoomID, testSong(fmt.Sprintf("song-%d", i)), ""); err != nil {
+			t.Fatalf("AddSongToQueue: %v", err)
+		}
+	}
+	createRoom("private", false)
+
+	names := []string{}
+	for offset := 0; offset < rooms; offset += 2 {
+		page, err := ds.PublicRooms(PublicRoomQuery{Limit: 2, Offset: offset})
+		if err != nil {
+			t.Fatalf("PublicRooms: %v", err)
+		}
+		if page.Total != rooms {
+			t.Errorf("total is %d, want %d", page.Total, rooms)
+		}
+		for _, room := range page.Rooms {
+			names = append(names, room.Name)
+			if room.NowPlaying == nil || room.NowPlaying.Stats.Title == "" {
+				t.Errorf("%s has no song playing", room.Name)
+			}
+		}
+	}
+	want := []string{"room-0", "room-1", "room-2", "room-3", "room-4"}
+	if !slices.Equal(names, want) {
+		t.Errorf("popular rooms are %v, want %v", names, want)
+	}
+
+	page, err := ds.PublicRooms(PublicRoomQuery{Search: "ROOM-2"})
+	if err != nil {
+		t.Fatalf("PublicRooms: %v", err)
+	}
+	if page.Total != 1 || len(page.Rooms) != 1 || page.Rooms[0].Name != "room-2" {
+		t.Errorf("searching for ROOM-2 found %+v", page)
+	}
+}
+
+// a song the room's rules turn away must not end up in the catalog
+func TestRejectedSongIsNotCataloged(t *testing.T) {
+	ds := NewMemoryDocumentStore(log.New(io.Discard, "", 0))
+	if err := ds.InsertNewUser("host", "password"); err != nil {
+		t.Fatalf("InsertNewUser: %v", err)
+	}
+	created, err := ds.CreateRoom("host", "test room", 60, 50, false, RoomRules{MaxConsecutivePerUser: 1}, QueueOrdering{}, time.Time{})
+	if err != nil {
+		t.Fatalf("CreateRoom: %v", err)
+	}
+	roomID := created.RoomProps.RoomID
+	first, second := testSong("first"), testSong("second")
+	second.Metadata.AddedBy = first.Metadata.AddedBy
+	if err := ds.AddSongToQueue(roomID, first, ""); err != nil {
+		t.Fatalf("AddSongToQueue: %v", err)
+	}
+	if err := ds.AddSongToQueue(roomID, second, ""); !errors.Is(err, ErrTooManyConsecutiveSongs) {
+		t.Fatalf("adding a second song in a row returned %v, want ErrTooManyConsecutiveSongs", err)
+	}
+
+	catalogID := func(song Song) string {
+		return CatalogID(song.Stats.Title, song.Stats.Artist, song.Stats.Album, "")
+	}
+	if _, err := ds.GetCatalogSong(catalogID(first)); err != nil {
+		t.Errorf("the queued song is not in the catalog: %v", err)
+	}
+	if _, err := ds.GetCatalogSong(catalogID(second)); err != ErrSongNotInCatalog {
+		t.Errorf("looking up the rejected song returned %v, want ErrSongNotInCatalog", err)
+	}
+}
+
+// racingBackend runs beforeDelete once, right before the first room delete, as if another request
+// wrote the room after it was read for ending the session
+type racingBackend struct {
+	*memoryBackend
+	beforeDelete func()
+}
+
+func (rb *racingBackend) deleteRoom(room *Room) (bool, error) {
+	if rb.beforeDelete != nil {
+		race := rb.beforeDelete
+		rb.beforeDelete = nil
+		race()
+	}
+	return rb.memoryBackend.deleteRoom(room)
+}
+
+func TestEndSessionArchivesLatestRoom(t *testing.T) {
+	ds, roomID := newTestStore(t)
+	for _, id := range []string{"first", "second", "third"} {
+		if err := ds.AddSongToQueue(roomID, testSong(id), ""); err != nil {
+			t.Fatalf("AddSongToQueue: %v", err)
+		}
+	}
+	if _, _, err := ds.NextSong(roomID); err != nil {
+		t.Fatalf("NextSong: %v", err)
+	}
+	ds.backend = &racingBackend{memoryBackend: ds.backend.(*memoryBackend), beforeDelete: func() {
+		if _, _, err := ds.NextSong(roomID); err != nil {
+			t.Errorf("NextSong: %v", err)
+		}
+	}}
+
+	if _, err := ds.DeleteRoom("host", roomID); err != nil {
+		t.Fatalf("DeleteRoom: %v", err)
+	}
+	if ds.RoomExist(roomID) {
+		t.Error("the room still exists after ending its session")
+	}
+	session, err := ds.GetSession(roomID)
+	if err != nil {
+		t.Fatalf("GetSession: %v", err)
+	}
+	if len(session.PlayedSongs) != 2 {
+		t.Errorf("the archive has %d played songs, want the 2 played before the room was deleted", len(session.PlayedSongs))
+	}
+}
+
+func TestSongVoteEvent(t *testing.T) {
+	for operation, want := range map[string]events.Type{
+		"like":       events.SongLiked,
+		"dislike":    events.SongDisliked,
+		"un-like":    events.SongUnliked,
+		"un-dislike": events.SongUndisliked,
+	} {
+		if got := SongVoteEvent(operation); got != want {
+			t.Errorf("SongVoteEvent(%q) is %q, want %q", operation, got, want)
+		}
+	}
+}
+
+func hostsSession(t *testing.T, ds *DocumentStore, username string) bool {
+	t.Helper()
+	user, err := ds.backend.findUser(username)
+	if err != nil {
+		t.Fatalf("findUser(%s): %v", username, err)
+	}
+	info, err := ds.backend.findUserInfo(user.ID.Hex())
+	if err != nil {
+		t.Fatalf("findUserInfo(%s): %v", username, err)
+	}
+	return info.InSession
+}
+
+// two transfers of one room at once hand it to exactly one user, the other keeps no claim on a session
+func TestConcurrentHostTransfers(t *testing.T) {
+	ds, roomID := newTestStore(t)
+	room, err := ds.findRoom(roomID)
+	if err != nil {
+		t.Fatalf("findRoom: %v", err)
+	}
+	candidates := []string{"first", "second"}
+	for _, username := range candidates {
+		if err := ds.InsertNewUser(username, "password"); err != nil {
+			t.Fatalf("InsertNewUser: %v", err)
+		}
+		if _, err := ds.AddUserToRoom(roomID, room.Stats.RoomPassword, username); err != nil {
+			t.Fatalf("AddUserToRoom: %v", err)
+		}
+	}
+
+	errs := make([]error, len(candidates))
+	var wg sync.WaitGroup
+	for i, username := range candidates {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, errs[i] = ds.TransferHost(roomID, "host", username)
+		}()
+	}
+	wg.Wait()
+
+	room, err = ds.findRoom(roomID)
+	if err != nil {
+		t.Fatalf("findRoom: %v", err)
+	}
+	for i, username := range candidates {
+		won := room.HostID == username
+		if won != (errs[i] == nil) {
+			t.Errorf("transfer to %s returned %v but the room is hosted by %s", username, errs[i], room.HostID)
+		}
+		if hostsSession(t, ds, username) != won {
+			t.Errorf("%s has inSession %t, want %t", username, !won, won)
+		}
+	}
+	if hostsSession(t, ds, "host") {
+		t.Error("the previous host is still marked as hosting a session")
+	}
+}
+
+// a transfer racing the new host's own CreateRoom leaves them hosting at most one room
+func TestHostTransferRacesCreateRoom(t *testing.T) {
+	ds, roomID := newTestStore(t)
+	room, err := ds.findRoom(roomID)
+	if err != nil {
+		t.Fatalf("findRoom: %v", err)
+	}
+	if err := ds.InsertNewUser("guest", "password"); err != nil {
+		t.Fatalf("InsertNewUser: %v", err)
+	}
+	if _, err := ds.AddUserToRoom(roomID, room.Stats.RoomPassword, "guest"); err != nil {
+		t.Fatalf("AddUserToRoom: %v", err)
+	}
+
+	var transferErr, createErr error
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		_, transferErr = ds.TransferHost(roomID, "host", "guest")
+	}()
+	go func() {
+		defer wg.Done()
+		_, createErr = ds.CreateRoom("guest", "own room", 60, 50, false, RoomRules{}, QueueOrdering{}, time.Time{})
+	}()
+	wg.Wait()
+
+	if (transferErr == nil) == (createErr == nil) {
+		t.Fatalf("transfer returned %v and CreateRoom returned %v, want exactly one to succeed", transferErr, createErr)
+	}
+	if transferErr != nil && transferErr != ErrNewHostUnavailable {
+		t.Errorf("transfer returned %v, want ErrNewHostUnavailable", transferErr)
+	}
+	if createErr != nil && createErr != ErrCannotCreateRoomAlreadyInSession {
+		t.Errorf("CreateRoom returned %v, want ErrCannotCreateRoomAlreadyInSession", createErr)
+	}
+	if !hostsSession(t, ds, "guest") {
+		t.Error("guest hosts a room but isn't marked as in a session")
+	}
+}
+
+func TestSetCoHostLeavesPermissionsAlone(t *testing.T) {
+	ds, roomID := newTestStore(t)
+	room, err := ds.findRoom(roomID)
+	if err != nil {
+		t.Fatalf("findRoom: %v", err)
+	}
+	if _, err := ds.AddUserToRoom(roomID, room.Stats.RoomPassword, "guest"); err != nil {
+		t.Fatalf("AddUserToRoom: %v", err)
+	}
+	permissions := []string{PermissionSkip, PermissionKick, PermissionSkip}
+	coHosts, err := ds.SetCoHost(roomID, "host", "guest", permissions)
+	if err != nil {
+		t.Fatalf("SetCoHost: %v", err)
+	}
+	if want := []string{PermissionSkip, PermissionKick, PermissionSkip}; !slices.Equal(permissions, want) {
+		t.Errorf("the caller's permissions were changed to %v", permissions)
+	}
+	if len(coHosts) != 1 || len(coHosts[0].Permissions) != 2 {
+		t.Errorf("co-hosts are %+v, want guest with 2 permissions", coHosts)
+	}
+}
+
+func TestHostVotesAreSaved(t *testing.T) {
+	ds, roomID := newTestStore(t)
+	for _, id := range []string{"liked", "disliked"} {
+		if err := ds.AddSongToQueue(roomID, testSong(id), ""); err != nil {
+			t.Fatalf("AddSongToQueue: %v", err)
+		}
+	}
+	if _, _, err := ds.SongOperation(roomID, "liked", "host", "like"); err != nil {
+		t.Fatalf("SongOperation: %v", err)
+	}
+	if _, _, err := ds.SongOperation(roomID, "disliked", "host", "dislike"); err != nil {
+		t.Fatalf("SongOperation: %v", err)
+	}
+	user, err := ds.backend.findUser("host")
+	if err != nil {
+		t.Fatalf("findUser: %v", err)
+	}
+	info, err := ds.backend.findUserInfo(user.ID.Hex())
+	if err != nil {
+		t.Fatalf("findUserInfo: %v", err)
+	}
+	if !slices.Equal(info.LikedSongs, []string{"liked"}) || !slices.Equal(info.DislikedSongs, []string{"disliked"}) {
+		t.Errorf("the host liked %v and disliked %v, want [liked] and [disliked]", info.LikedSongs, info.DislikedSongs)
+	}
+}
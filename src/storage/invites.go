@@ -0,0 +1,109 @@
+package storage
+
+import (
+	"BeatBus/internal"
+	"fmt"
+	"time"
+)
+
+var (
+	ErrNoInvite         = fmt.Errorf("the room has no invite link, create one first")
+	ErrInviteReplaced   = fmt.Errorf("this invite link was replaced by the host, ask them for the new one")
+	ErrInviteUsedUp     = fmt.Errorf("this invite link has been used as many times as the host allowed")
+	ErrInvalidInviteUse = fmt.Errorf("maxUses can't be negative")
+)
+
+// RoomInvite is the invite link that currently lets people into a room without the password.
+// Making a new one replaces it, which is how a leaked link is cut off.
+type RoomInvite struct {
+	ID        string    `bson:"id"`
+	ExpiresAt time.Time `bson:"expiresAt"`
+	MaxUses   int64     `bson:"maxUses"` // 0 means no limit
+	Uses      int64     `bson:"uses"`
+	CreatedAt time.Time `bson:"createdAt"`
+}
+
+// Invite is what the host shares, Token goes in the invite link
+type Invite struct {
+	RoomID    string `json:"roomID"`
+	Token     string `json:"token"`
+	ExpiresAt int64  `json:"expiresAt"` // unix seconds
+	MaxUses   int64  `json:"maxUses"`
+	Uses      int64  `json:"uses"`
+}
+
+func inviteOf(roomID string, invite *RoomInvite) Invite {
+	return Invite{
+		RoomID: roomID,
+		Token: internal.SignInvite(internal.InviteClaims{
+			RoomID:    roomID,
+			InviteID:  invite.ID,
+			ExpiresAt: invite.ExpiresAt.Unix(),
+		}),
+		ExpiresAt: invite.ExpiresAt.Unix(),
+		MaxUses:   invite.MaxUses,
+		Uses:      invite.Uses,
+	}
+}
+
+// CreateInvite replaces the room's invite link with a new one that lasts for ttl and works maxUses times.
+// A ttl of 0, or one past the end of the room, makes the link last as long as the room.
+func (ds *DocumentStore) CreateInvite(roomID, hostUsername string, ttl time.Duration, maxUses int64) (Invite, error) {
+	if maxUses < 0 {
+		return Invite{}, ErrInvalidInviteUse
+	}
+	var invite Invite
+	err := ds.updateRoomVersioned(roomID, func(room *Room) error {
+		if room.HostID != hostUsername {
+			return ErrNotRoomHost
+		}
+		now := time.Now()
+		expiresAt := room.EndTime()
+		if ttl > 0 && now.Add(ttl).Before(expiresAt) {
+			expiresAt = now.Add(ttl)
+		}
+		room.Invite = &RoomInvite{
+			ID:        internal.RandomHash(),
+			ExpiresAt: expiresAt,
+			MaxUses:   maxUses,
+			CreatedAt: now,
+		}
+		invite = inviteOf(roomID, room.Invite)
+		return nil
+	})
+	return invite, err
+}
+
+// CurrentInvite returns the invite link the room has now, ErrNoInvite if the host hasn't made one
+func (ds *DocumentStore) CurrentInvite(roomID, hostUsername string) (Invite, error) {
+	room, err := ds.findRoom(roomID)
+	if err != nil {
+		return Invite{}, err
+	}
+	if room.HostID != hostUsername {
+		return Invite{}, ErrNotRoomHost
+	}
+	if room.Invite == nil {
+		return Invite{}, ErrNoInvite
+	}
+	return inviteOf(roomID, room.Invite), nil
+}
+
+// AddUserWithInvite is AddUserToRoom for users holding an invite link instead of the password.
+// inviteID comes from a verified invite token, the link counts as used only when someone new gets in.
+func (ds *DocumentStore) AddUserWithInvite(roomID, inviteID, username string) (time.Duration, error) {
+	return ds.admitUser(roomID, username, func(room *Room) error {
+		if room.Invite == nil || room.Invite.ID != inviteID {
+			return ErrInviteReplaced
+		}
+		if !time.Now().Before(room.Invite.ExpiresAt) {
+			return internal.ErrInviteExpired
+		}
+		if room.Invite.MaxUses > 0 && room.Invite.Uses >= room.Invite.MaxUses {
+			return ErrInviteUsedUp
+		}
+		return nil
+	}, func(room *Room) {
+		room.Invite.Uses++
+	})
+}
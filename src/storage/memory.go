@@ -0,0 +1,688 @@
+package storage
+
+import (
+	"BeatBus/events"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// memoryBackend keeps documents in maps. They are stored bson encoded, the same way Mongo would
+// store them, so callers never share memory with the store and decoding behaves like it does in production.
+type memoryBackend struct {
+	mu        sync.Mutex
+	rooms     map[string][]byte // by roomID
+	users     map[string][]byte // by username
+	usersInfo map[string][]byte // by user_id
+	songs     map[string][]byte // by catalog id
+	sessions  map[string][]byte // by session id
+}
+
+func newMemoryBackend() *memoryBackend {
+	return &memoryBackend{
+		rooms:     map[string][]byte{},
+		users:     map[string][]byte{},
+		usersInfo: map[string][]byte{},
+		songs:     map[string][]byte{},
+		sessions:  map[string][]byte{},
+	}
+}
+
+func (mb *memoryBackend) findRoom(roomID string) (*Room, error) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	return mb.room(roomID)
+}
+
+func (mb *memoryBackend) room(roomID string) (*Room, error) {
+	raw, ok := mb.rooms[roomID]
+	if !ok {
+		return nil, ErrRoomDoesntExist
+	}
+	var room Room
+	if err := bson.Unmarshal(raw, &room); err != nil {
+		return nil, err
+	}
+	return &room, nil
+}
+
+func (mb *memoryBackend) roomExists(roomID string) (bool, error) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	_, ok := mb.rooms[roomID]
+	return ok, nil
+}
+
+func (mb *memoryBackend) findExpiredRooms(now time.Time) ([]*Room, error) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	var expired []*Room
+	for roomID := range mb.rooms {
+		room, err := mb.room(roomID)
+		if err != nil {
+			return nil, err
+		}
+		if !now.Before(room.EndTime()) {
+			expired = append(expired, room)
+		}
+	}
+	return expired, nil
+}
+
+func (mb *memoryBackend) findPublicRooms(now time.Time, query PublicRoomQuery) ([]*Room, int, error) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	var public []*Room
+	for roomID := range mb.rooms {
+		room, err := mb.room(roomID)
+		if err != nil {
+			return nil, 0, err
+		}
+		if room.Stats.Public && now.Before(room.EndTime()) && strings.Contains(strings.ToLower(room.Stats.Name), strings.ToLower(query.Search)) {
+			public = append(public, room)
+		}
+	}
+	slices.SortFunc(public, publicRoomOrder(query.Sort))
+	page := []*Room{}
+	if query.Offset < len(public) {
+		page = public[query.Offset:min(query.Offset+query.Limit, len(public))]
+	}
+	for _, room := range page {
+		room.CurrentQueue = room.CurrentQueue[:min(len(room.CurrentQueue), 1)]
+		room.PlayedSongs = nil
+	}
+	return page, len(public), nil
+}
+
+func (mb *memoryBackend) insertRoom(room *Room) error {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	if room.ID.IsZero() {
+		room.ID = primitive.NewObjectID()
+	}
+	raw, err := bson.Marshal(room)
+	if err != nil {
+		return err
+	}
+	mb.rooms[room.RoomID] = raw
+	return nil
+}
+
+func (mb *memoryBackend) replaceRoom(room *Room) (bool, error) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	stored, err := mb.room(room.RoomID)
+	if err == ErrRoomDoesntExist {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if !sameVersion(stored.Version, room.Version) {
+		return false, nil
+	}
+	next := int64(1)
+	if room.Version != nil {
+		next = *room.Version + 1
+	}
+	replacement := *room
+	replacement.Version = &next
+	raw, err := bson.Marshal(replacement)
+	if err != nil {
+		return false, err
+	}
+	mb.rooms[room.RoomID] = raw
+	room.Version = &next
+	return true, nil
+}
+
+func sameVersion(a, b *int64) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return *a == *b
+}
+
+func (mb *memoryBackend) deleteRoom(room *Room) (bool, error) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	stored, err := mb.room(room.RoomID)
+	if err == ErrRoomDoesntExist {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if !sameVersion(stored.Version, room.Version) {
+		return false, nil
+	}
+	delete(mb.rooms, room.RoomID)
+	return true, nil
+}
+
+func (mb *memoryBackend) findUser(username string) (*User, error) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	raw, ok := mb.users[username]
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	var user User
+	if err := bson.Unmarshal(raw, &user); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (mb *memoryBackend) insertUser(user *User) (string, error) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	if _, ok := mb.users[user.Username]; ok {
+		return "", ErrUserNameTaken
+	}
+	if user.ID.IsZero() {
+		user.ID = primitive.NewObjectID()
+	}
+	raw, err := bson.Marshal(user)
+	if err != nil {
+		return "", err
+	}
+	mb.users[user.Username] = raw
+	return user.ID.Hex(), nil
+}
+
+func (mb *memoryBackend) updateUserPassword(username, hashedPassword string) error {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	raw, ok := mb.users[username]
+	if !ok {
+		return ErrUserNotFound
+	}
+	var user User
+	if err := bson.Unmarshal(raw, &user); err != nil {
+		return err
+	}
+	user.Password = hashedPassword
+	raw, err := bson.Marshal(user)
+	if err != nil {
+		return err
+	}
+	mb.users[username] = raw
+	return nil
+}
+
+func (mb *memoryBackend) insertUserInfo(info *UserInfo) error {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	if info.ID.IsZero() {
+		info.ID = primitive.NewObjectID()
+	}
+	raw, err := bson.Marshal(info)
+	if err != nil {
+		return err
+	}
+	mb.usersInfo[info.UserID] = raw
+	return nil
+}
+
+func (mb *memoryBackend) findUserInfo(userID string) (*UserInfo, error) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	return mb.userInfo(userID)
+}
+
+func (mb *memoryBackend) userInfo(userID string) (*UserInfo, error) {
+	raw, ok := mb.usersInfo[userID]
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	var info UserInfo
+	if err := bson.Unmarshal(raw, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// updateUserInfo runs update on the user info of userID and stores the result
+func (mb *memoryBackend) updateUserInfo(userID string, update func(info *UserInfo) error) error {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	info, err := mb.userInfo(userID)
+	if err != nil {
+		return err
+	}
+	if err := update(info); err != nil {
+		return err
+	}
+	raw, err := bson.Marshal(info)
+	if err != nil {
+		return err
+	}
+	mb.usersInfo[userID] = raw
+	return nil
+}
+
+func (mb *memoryBackend) setInSession(userID string, inSession bool) error {
+	return mb.updateUserInfo(userID, func(info *UserInfo) error {
+		info.InSession = inSession
+		return nil
+	})
+}
+
+func (mb *memoryBackend) claimSession(userID string) (bool, error) {
+	claimed := false
+	err := mb.updateUserInfo(userID, func(info *UserInfo) error {
+		claimed = !info.InSession
+		info.InSession = true
+		return nil
+	})
+	return claimed, err
+}
+
+func (mb *memoryBackend) addToUserInfo(userID, list, value string) error {
+	return mb.updateUserInfo(userID, func(info *UserInfo) error {
+		var values *[]string
+		switch list {
+		case userInfoPreviousSessions:
+			values = &info.PreviousSessions
+		case userInfoLikedSongs:
+			values = &info.LikedSongs
+		case userInfoDislikedSongs:
+			values = &info.DislikedSongs
+		default:
+			return fmt.Errorf("unknown user info list %s", list)
+		}
+		*values = addVoter(*values, value)
+		return nil
+	})
+}
+
+func (mb *memoryBackend) upsertCatalogSong(song *CatalogSong) error {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	if _, ok := mb.songs[song.CatalogID]; ok {
+		return nil
+	}
+	raw, err := bson.Marshal(song)
+	if err != nil {
+		return err
+	}
+	mb.songs[song.CatalogID] = raw
+	return nil
+}
+
+func (mb *memoryBackend) findCatalogSong(catalogID string) (*CatalogSong, error) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	return mb.catalogSong(catalogID)
+}
+
+func (mb *memoryBackend) catalogSong(catalogID string) (*CatalogSong, error) {
+	raw, ok := mb.songs[catalogID]
+	if !ok {
+		return nil, ErrSongNotInCatalog
+	}
+	var song CatalogSong
+	if err := bson.Unmarshal(raw, &song); err != nil {
+		return nil, err
+	}
+	return &song, nil
+}
+
+func (mb *memoryBackend) recordCatalogPlays(plays []catalogPlay) error {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	for _, play := range plays {
+		song, err := mb.catalogSong(play.CatalogID)
+		if err == ErrSongNotInCatalog {
+			continue // same as an update in Mongo that matches nothing
+		} else if err != nil {
+			return err
+		}
+		song.Likes += int64(play.Likes)
+		song.Dislikes += int64(play.Dislikes)
+		if play.Played {
+			song.Plays++
+		} else {
+			song.Skips++
+		}
+		song.Rooms = addVoter(song.Rooms, play.RoomID)
+		if play.PlayedAt.After(song.LastPlayedAt) {
+			song.LastPlayedAt = play.PlayedAt
+		}
+		raw, err := bson.Marshal(song)
+		if err != nil {
+			return err
+		}
+		mb.songs[play.CatalogID] = raw
+	}
+	return nil
+}
+
+func (mb *memoryBackend) insertSession(session *Session) error {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	if _, ok := mb.sessions[session.SessionID]; ok {
+		return fmt.Errorf("session %s is already archived", session.SessionID)
+	}
+	raw, err := bson.Marshal(session)
+	if err != nil {
+		return err
+	}
+	mb.sessions[session.SessionID] = raw
+	return nil
+}
+
+func (mb *memoryBackend) findSession(sessionID string) (*Session, error) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	return mb.session(sessionID)
+}
+
+func (mb *memoryBackend) session(sessionID string) (*Session, error) {
+	raw, ok := mb.sessions[sessionID]
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+	var session Session
+	if err := bson.Unmarshal(raw, &session); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+func (mb *memoryBackend) findUserSessions(username string) ([]*Session, error) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	var sessions []*Session
+	for sessionID := range mb.sessions {
+		session, err := mb.session(sessionID)
+		if err != nil {
+			return nil, err
+		}
+		if session.HostID == username || slices.Contains(session.Participants, username) {
+			sessions = append(sessions, session)
+		}
+	}
+	slices.SortFunc(sessions, func(a, b *Session) int {
+		return b.EndedAt.Compare(a.EndedAt)
+	})
+	return sessions, nil
+}
+
+// memoryBus is an EventBus and Cache that lives in the process, the in-memory stand in for Redis.
+// Event IDs look like stream IDs ("<unix ms>-<sequence>") so clients can't tell the two apart.
+type memoryBus struct {
+	mu          sync.Mutex
+	logs        map[string][]events.Event
+	subscribers map[string]map[*memorySubscription]struct{}
+	keys        map[string]memoryKey
+	presence    map[string]map[string]time.Time // roomID -> username -> last seen
+	revoked     map[string]time.Time            // jti -> when the token expires
+	tokenGroups map[string]map[string]time.Time // group -> jti -> when the token expires
+	lastMillis  int64
+	lastSeq     int64
+}
+
+type memoryKey struct {
+	value     interface{}
+	expiresAt time.Time // zero if the key never expires
+}
+
+func (k memoryKey) expired(now time.Time) bool {
+	return !k.expiresAt.IsZero() && !now.Before(k.expiresAt)
+}
+
+// NewMemoryBus returns a Broker that keeps everything in memory, for tests and local dev
+func NewMemoryBus() Broker {
+	return &memoryBus{
+		logs:        map[string][]events.Event{},
+		subscribers: map[string]map[*memorySubscription]struct{}{},
+		keys:        map[string]memoryKey{},
+		presence:    map[string]map[string]time.Time{},
+		revoked:     map[string]time.Time{},
+		tokenGroups: map[string]map[string]time.Time{},
+	}
+}
+
+func (mb *memoryBus) nextID() string {
+	millis := time.Now().UnixMilli()
+	if millis > mb.lastMillis {
+		mb.lastMillis, mb.lastSeq = millis, 0
+	} else {
+		mb.lastSeq++
+	}
+	return fmt.Sprintf("%d-%d", mb.lastMillis, mb.lastSeq)
+}
+
+func (mb *memoryBus) UpdateChannel(channel string, event events.Event) error {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	event.ID = mb.nextID()
+	logged := append(mb.logs[channel], event)
+	if len(logged) > EventLogMaxLen {
+		logged = logged[len(logged)-EventLogMaxLen:]
+	}
+	mb.logs[channel] = logged
+	for sub := range mb.subscribers[channel] {
+		select {
+		case sub.events <- event:
+		default:
+			// a subscriber that stopped reading drops events, like a slow Redis subscriber would
+		}
+	}
+	return nil
+}
+
+func (mb *memoryBus) ReadEvents(channel, afterID string) ([]events.Event, error) {
+	var after [2]int64
+	if afterID != "" {
+		parsed, err := parseEventID(afterID)
+		if err != nil {
+			return nil, err
+		}
+		after = parsed
+	}
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	logged := []events.Event{}
+	for _, event := range mb.logs[channel] {
+		id, _ := parseEventID(event.ID)
+		if afterID == "" || id[0] > after[0] || (id[0] == after[0] && id[1] > after[1]) {
+			logged = append(logged, event)
+		}
+	}
+	return logged, nil
+}
+
+// parseEventID splits "<ms>-<seq>", a bare "<ms>" means sequence 0 like it does for streams
+func parseEventID(id string) ([2]int64, error) {
+	millis, seq, found := strings.Cut(id, "-")
+	var parsed [2]int64
+	var err error
+	if parsed[0], err = strconv.ParseInt(millis, 10, 64); err != nil {
+		return parsed, ErrInvalidEventID
+	}
+	if found {
+		if parsed[1], err = strconv.ParseInt(seq, 10, 64); err != nil {
+			return parsed, ErrInvalidEventID
+		}
+	}
+	return parsed, nil
+}
+
+func (mb *memoryBus) LastEventID(channel string) (string, error) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	logged := mb.logs[channel]
+	if len(logged) == 0 {
+		return "", nil
+	}
+	return logged[len(logged)-1].ID, nil
+}
+
+func (mb *memoryBus) SubscribeChannel(channel string) (Subscription, error) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	sub := &memorySubscription{bus: mb, channel: channel, events: make(chan events.Event, 100)}
+	if mb.subscribers[channel] == nil {
+		mb.subscribers[channel] = map[*memorySubscription]struct{}{}
+	}
+	mb.subscribers[channel][sub] = struct{}{}
+	return sub, nil
+}
+
+type memorySubscription struct {
+	bus     *memoryBus
+	channel string
+	events  chan events.Event
+}
+
+func (ms *memorySubscription) Events() <-chan events.Event {
+	return ms.events
+}
+
+func (ms *memorySubscription) Close() error {
+	ms.bus.mu.Lock()
+	defer ms.bus.mu.Unlock()
+	if _, ok := ms.bus.subscribers[ms.channel][ms]; ok {
+		delete(ms.bus.subscribers[ms.channel], ms)
+		close(ms.events)
+	}
+	return nil
+}
+
+func (mb *memoryBus) EnsureKeyExists(key string) error {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	k, ok := mb.keys[key]
+	if !ok || k.expired(time.Now()) {
+		return ErrKeyDoesNotExist
+	}
+	return nil
+}
+
+func (mb *memoryBus) GetKey(key string) (string, error) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	k, ok := mb.keys[key]
+	if !ok || k.expired(time.Now()) {
+		return "", ErrKeyDoesNotExist
+	}
+	return fmt.Sprint(k.value), nil
+}
+
+func (mb *memoryBus) SetKeyWithExpiry(key string, value interface{}, expiration time.Duration) error {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	k := memoryKey{value: value}
+	if expiration > 0 {
+		k.expiresAt = time.Now().Add(expiration)
+	}
+	mb.keys[key] = k
+	return nil
+}
+
+func (mb *memoryBus) Incr(key string) error {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	k, ok := mb.keys[key]
+	if !ok || k.expired(time.Now()) {
+		k = memoryKey{value: int64(0)}
+	}
+	count, err := strconv.ParseInt(fmt.Sprint(k.value), 10, 64)
+	if err != nil {
+		return fmt.Errorf("value of %s is not an integer", key)
+	}
+	k.value = count + 1
+	mb.keys[key] = k
+	return nil
+}
+
+func (mb *memoryBus) Touch(roomID, username string, at time.Time) error {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	if mb.presence[roomID] == nil {
+		mb.presence[roomID] = map[string]time.Time{}
+	}
+	mb.presence[roomID][username] = at
+	return nil
+}
+
+func (mb *memoryBus) Forget(roomID, username string) error {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	delete(mb.presence[roomID], username)
+	return nil
+}
+
+func (mb *memoryBus) SeenSince(roomID string, since time.Time) ([]string, error) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	seen := []string{}
+	for username, at := range mb.presence[roomID] {
+		if !at.Before(since) {
+			seen = append(seen, username)
+		}
+	}
+	return seen, nil
+}
+
+func (mb *memoryBus) Revoke(jti string, until time.Time) (bool, error) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	return mb.revoke(jti, until), nil
+}
+
+// revoke expects mb.mu to be held, expired entries are dropped along the way.
+// It reports false if the token was already revoked or has expired.
+func (mb *memoryBus) revoke(jti string, until time.Time) bool {
+	now := time.Now()
+	for id, expiresAt := range mb.revoked {
+		if !now.Before(expiresAt) {
+			delete(mb.revoked, id)
+		}
+	}
+	if _, revoked := mb.revoked[jti]; revoked || !now.Before(until) {
+		return false
+	}
+	mb.revoked[jti] = until
+	return true
+}
+
+func (mb *memoryBus) IsRevoked(jti string) (bool, error) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	until, ok := mb.revoked[jti]
+	return ok && time.Now().Before(until), nil
+}
+
+func (mb *memoryBus) Track(group, jti string, until time.Time) error {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	if mb.tokenGroups[group] == nil {
+		mb.tokenGroups[group] = map[string]time.Time{}
+	}
+	now := time.Now()
+	for id, expiresAt := range mb.tokenGroups[group] {
+		if !now.Before(expiresAt) {
+			delete(mb.tokenGroups[group], id)
+		}
+	}
+	mb.tokenGroups[group][jti] = until
+	return nil
+}
+
+func (mb *memoryBus) RevokeGroup(group string) error {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	for jti, until := range mb.tokenGroups[group] {
+		mb.revoke(jti, until)
+	}
+	delete(mb.tokenGroups, group)
+	return nil
+}
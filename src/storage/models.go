@@ -0,0 +1,242 @@
+package storage
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Room is a document in the rooms collection. The bson names are the ones rooms have always been stored with,
+// so rooms written before these types existed still decode.
+type Room struct {
+	ID           primitive.ObjectID `bson:"_id,omitempty" json:"-"`
+	RoomID       string             `bson:"roomID" json:"roomID"`
+	HostID       string             `bson:"hostID" json:"hostID"`
+	CurrentQueue []QueueEntry       `bson:"CurrentQueue" json:"currentQueue"` // the head of the queue is the song playing
+	PlayedSongs  []QueueEntry       `bson:"playedSongs" json:"playedSongs"`
+	SongCount    int64              `bson:"songCount" json:"songCount"` // songs ever added, used as the next song's position
+	// bumped by every queue mutation, see updateRoomVersioned. nil for rooms created before versioning
+	Version      *int64      `bson:"version,omitempty" json:"-"`
+	UsersJoined  []string    `bson:"usersJoined" json:"usersJoined"`             // who is in the room now, leaving or being kicked takes you out
+	Participants []string    `bson:"participants,omitempty" json:"participants"` // everyone who ever joined, see participantsOf
+	CoHosts      []CoHost    `bson:"coHosts,omitempty" json:"coHosts"`
+	Banned       []string    `bson:"banned,omitempty" json:"banned"` // can't join again for the rest of the session
+	Invite       *RoomInvite `bson:"invite,omitempty" json:"-"`      // the one invite link that works, nil until the host makes one
+	Stats        RoomStats   `bson:"RoomStats" json:"roomStats"`
+}
+
+type RoomStats struct {
+	Name         string        `bson:"name" json:"name"`
+	Lifetime     int64         `bson:"lifetime" json:"lifetime"` // in minutes
+	MaxUsers     int64         `bson:"maxUsers" json:"maxUsers"`
+	Public       bool          `bson:"public" json:"public"`
+	CreatedAt    time.Time     `bson:"createdAt" json:"createdAt"`
+	StartsAt     time.Time     `bson:"startsAt,omitempty" json:"startsAt,omitzero"` // zero for rooms that started when they were created
+	RoomPassword string        `bson:"roomPassword" json:"roomPassword"`
+	Rules        RoomRules     `bson:"rules" json:"rules"`
+	Ordering     QueueOrdering `bson:"ordering" json:"ordering"`
+}
+
+// StartTime is when the party starts, the lifetime is counted from it
+func (r *Room) StartTime() time.Time {
+	if r.Stats.StartsAt.IsZero() {
+		return r.Stats.CreatedAt
+	}
+	return r.Stats.StartsAt
+}
+
+// EndTime is when the room's lifetime runs out
+func (r *Room) EndTime() time.Time {
+	return r.StartTime().Add(time.Duration(r.Stats.Lifetime) * time.Minute)
+}
+
+// TimeLeft is how long the room has until its lifetime runs out
+func (r *Room) TimeLeft() time.Duration {
+	return time.Until(r.EndTime())
+}
+
+// Scheduled reports whether the party hasn't started yet. Guests can already join and queue songs
+// but nothing plays until the start time.
+func (r *Room) Scheduled(now time.Time) bool {
+	return now.Before(r.StartTime())
+}
+
+// QueueEntry is a song in a room's queue or history
+type QueueEntry struct {
+	Song          Song      `bson:"song" json:"song"`
+	AlreadyPlayed bool      `bson:"alreadyPlayed" json:"alreadyPlayed"`
+	Position      int64     `bson:"position" json:"position"`                    // order the song was added to the room in
+	Pinned        bool      `bson:"pinned,omitempty" json:"pinned,omitempty"`    // moved by the host, automatic ordering leaves it be
+	PlayedAt      time.Time `bson:"playedAt,omitempty" json:"playedAt,omitzero"` // zero until the song has played
+	Skipped       bool      `bson:"skipped,omitempty" json:"skipped,omitempty"`  // the room voted the song off
+	SkipVotes     []string  `bson:"skipVotes,omitempty" json:"skipVotes,omitempty"`
+	MyVote        string    `bson:"-" json:"myVote,omitempty"` // set per caller, see MarkMyVotes
+}
+
+type Song struct {
+	SongID    string       `bson:"songId" json:"songId"`
+	CatalogID string       `bson:"catalogId,omitempty" json:"catalogId,omitempty"`
+	Stats     SongStats    `bson:"stats" json:"stats"`
+	Metadata  SongMetadata `bson:"metadata" json:"metadata"`
+}
+
+type SongStats struct {
+	Title  string `bson:"title" json:"title"`
+	Artist string `bson:"artist" json:"artist"`
+	Album  string `bson:"album" json:"album"`
+}
+
+// SongMetadata is what happened to the song in this room. likes and dislikes always match the voter sets
+type SongMetadata struct {
+	AddedBy    string    `bson:"addedBy" json:"addedBy"`
+	AddedAt    time.Time `bson:"addedAt,omitempty" json:"addedAt,omitzero"` // zero for songs added before add times were recorded
+	Likes      int       `bson:"likes" json:"likes"`
+	Dislikes   int       `bson:"dislikes" json:"dislikes"`
+	LikedBy    []string  `bson:"likedBy" json:"likedBy"`
+	DislikedBy []string  `bson:"dislikedBy" json:"dislikedBy"`
+}
+
+// User is a document in the users collection
+type User struct {
+	ID       primitive.ObjectID `bson:"_id,omitempty" json:"-"`
+	Username string             `bson:"username" json:"username"`
+	Password string             `bson:"password" json:"-"`
+}
+
+// RoomProps is what the host gets back when a room is created or its settings change
+type RoomProps struct {
+	RoomID       string        `json:"roomID"`
+	RoomPassword string        `json:"roomPassword"`
+	HostID       string        `json:"hostID"`
+	RoomName     string        `json:"roomName"`
+	MaxUsers     int64         `json:"maxUsers"`
+	IsPublic     bool          `json:"isPublic"`
+	Rules        RoomRules     `json:"rules"`
+	Ordering     QueueOrdering `json:"ordering"`
+	CoHosts      []CoHost      `json:"coHosts"`
+	Lifetime     int64         `json:"lifetime"` // minutes, counted from startsAt
+	StartsAt     int64         `json:"startsAt"` // unix seconds
+	Scheduled    bool          `json:"scheduled"`
+	TimeLeft     int64         `json:"timeLeft"` // minutes
+}
+
+// AccessToken is a short lived access token and the refresh token that gets the next one, times are unix seconds
+type AccessToken struct {
+	Token            string `json:"token"`
+	ExpiresIn        int64  `json:"expiresIn"`
+	RefreshToken     string `json:"refreshToken"`
+	RefreshExpiresIn int64  `json:"refreshExpiresIn"`
+}
+
+type CreatedRoom struct {
+	RoomProps   RoomProps   `json:"roomProps"`
+	AccessToken AccessToken `json:"accessToken"`
+	TimeStamp   int64       `json:"timeStamp"`
+}
+
+type UpdatedRoom struct {
+	RoomProps   RoomProps    `json:"roomProps"`
+	AccessToken *AccessToken `json:"accessToken,omitempty"` // new host tokens that last as long as the room, only when the lifetime changed
+	TimeStamp   int64        `json:"timeStamp"`
+}
+
+// SessionSummary are the awards handed out when a session ends
+type SessionSummary struct {
+	MostLikedUser    UserLikeCount    `bson:"mostLikedUser" json:"mostLikedUser"`
+	MostDislikedUser UserDislikeCount `bson:"mostDislikedUser" json:"mostDislikedUser"`
+	MostLikedSong    QueueEntry       `bson:"mostLikedSong" json:"mostLikedSong"`
+	MostDislikedSong QueueEntry       `bson:"mostDislikedSong" json:"mostDislikedSong"`
+}
+
+type UserLikeCount struct {
+	Username  string `bson:"username" json:"username"`
+	LikeCount int    `bson:"likeCount" json:"like Count"`
+}
+
+type UserDislikeCount struct {
+	Username     string `bson:"username" json:"username"`
+	DislikeCount int    `bson:"dislikeCount" json:"dislike Count"`
+}
+
+// Session is a finished room, kept in the sessions collection so people can look back at past parties
+type Session struct {
+	SessionID    string         `bson:"_id" json:"sessionID"` // the ID the room had
+	RoomName     string         `bson:"roomName" json:"roomName"`
+	HostID       string         `bson:"hostID" json:"hostID"`
+	Participants []string       `bson:"participants" json:"participants"`
+	PlayedSongs  []QueueEntry   `bson:"playedSongs" json:"playedSongs"`
+	Summary      SessionSummary `bson:"summary" json:"summary"`
+	Lifetime     int64          `bson:"lifetime" json:"lifetime"` // minutes the room was created to last
+	StartedAt    time.Time      `bson:"startedAt" json:"startedAt"`
+	EndedAt      time.Time      `bson:"endedAt" json:"endedAt"`
+	EndReason    string         `bson:"endReason" json:"endReason"`
+}
+
+// RoomMetricsSnapshot are the live stats the host sees while the session is running
+type RoomMetricsSnapshot struct {
+	MostLikedSongs       []QueueEntry `json:"mostLikedSongs"`
+	MostDislikedSongs    []QueueEntry `json:"mostDislikedSongs"`
+	UserWithMostLikes    string       `json:"userWithMostLikes"`
+	UserWithMostDislikes string       `json:"userWithMostDislikes"`
+	RoomSize             int          `json:"roomSize"`          // users in the room, active or not
+	ActiveUsers          int          `json:"activeUsers"`       // users seen within storage.PresenceTimeout
+	TotalParticipants    int          `json:"totalParticipants"` // everyone who joined at some point, including those who left
+	QueueLength          int          `json:"queueLength"`
+}
+
+// RoomSnapshot is the full state sent to clients watching a room
+type RoomSnapshot struct {
+	RoomID        string       `json:"roomID"`
+	CurrentSong   *QueueEntry  `json:"currentSong"`
+	Queue         []QueueEntry `json:"queue"`         // Exclude the currently playing song
+	NumberOfUsers int          `json:"numberOfUsers"` // active users only
+	HostID        string       `json:"hostID"`
+	CoHosts       []CoHost     `json:"coHosts"`
+	Scheduled     bool         `json:"scheduled"` // the party hasn't started, see RoomSettings.startsAt
+	RoomSettings  RoomSettings `json:"RoomSettings"`
+}
+
+// RoomSettings is RoomStats without the room password, everyone watching the room gets it,
+// including people who joined with an invite link or without a password
+type RoomSettings struct {
+	Name      string        `json:"name"`
+	Lifetime  int64         `json:"lifetime"` // in minutes
+	MaxUsers  int64         `json:"maxUsers"`
+	Public    bool          `json:"public"`
+	CreatedAt time.Time     `json:"createdAt"`
+	StartsAt  time.Time     `json:"startsAt,omitzero"`
+	Rules     RoomRules     `json:"rules"`
+	Ordering  QueueOrdering `json:"ordering"`
+}
+
+func settingsOf(stats RoomStats) RoomSettings {
+	return RoomSettings{
+		Name:      stats.Name,
+		Lifetime:  stats.Lifetime,
+		MaxUsers:  stats.MaxUsers,
+		Public:    stats.Public,
+		CreatedAt: stats.CreatedAt,
+		StartsAt:  stats.StartsAt,
+		Rules:     stats.Rules,
+		Ordering:  stats.Ordering,
+	}
+}
+
+// UserInfo is a document in the usersInfo collection, user_id is the hex of the user's _id
+type UserInfo struct {
+	ID               primitive.ObjectID `bson:"_id,omitempty" json:"-"`
+	UserID           string             `bson:"user_id" json:"userID"`
+	InSession        bool               `bson:"inSession" json:"inSession"`
+	JoinDate         time.Time          `bson:"join_date" json:"joinDate"`
+	PreviousSessions []string           `bson:"previous_sessions" json:"previousSessions"`
+	ListenedTo       []string           `bson:"listened_to" json:"listenedTo"`
+	LikedSongs       []string           `bson:"liked_songs" json:"likedSongs"`
+	DislikedSongs    []string           `bson:"disliked_songs" json:"dislikedSongs"`
+}
+
+// lists of a UserInfo that addToUserInfo can add to
+const (
+	userInfoPreviousSessions = "previous_sessions"
+	userInfoLikedSongs       = "liked_songs"
+	userInfoDislikedSongs    = "disliked_songs"
+)
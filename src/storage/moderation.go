@@ -0,0 +1,82 @@
+package storage
+
+import (
+	"BeatBus/internal"
+	"fmt"
+	"slices"
+)
+
+var (
+	ErrUserBanned   = fmt.Errorf("you have been banned from this room")
+	ErrCantKickHost = fmt.Errorf("the host can't be kicked, hand the room over first")
+)
+
+// Kick is the outcome of removing a user from a room
+type Kick struct {
+	Username       string   `json:"username"`
+	Banned         bool     `json:"banned"`
+	RemovedSongIDs []string `json:"removedSongIDs"`         // the user's songs that were waiting in the queue
+	RoomPassword   string   `json:"roomPassword,omitempty"` // the new password, only when it was reset
+}
+
+// KickUser removes username from the room along with their pending songs, the song playing is left alone.
+// With ban they can't join again for the rest of the session, a ban also works on users who haven't joined.
+// Only the host can kick a co-host or reset the room password, which also drops the invite link,
+// so the old QR code stops working.
+func (ds *DocumentStore) KickUser(roomID, actor, username string, ban, resetPassword bool) (Kick, error) {
+	var kick Kick
+	err := ds.updateRoomVersioned(roomID, func(room *Room) error {
+		actorRole, err := roomRole(room, actor)
+		if err != nil || !actorRole.Can(PermissionKick) {
+			return ErrPermissionDenied
+		}
+		if resetPassword && actorRole.Role != internal.RoleHost {
+			return ErrNotRoomHost
+		}
+		targetRole, err := roomRole(room, username)
+		if err == ErrUserNotInRoom && !ban {
+			return ErrUserNotInRoom
+		}
+		switch targetRole.Role {
+		case internal.RoleHost:
+			return ErrCantKickHost
+		case internal.RoleCoHost:
+			if actorRole.Role != internal.RoleHost {
+				return ErrPermissionDenied
+			}
+		}
+
+		kick = Kick{Username: username, Banned: ban, RemovedSongIDs: []string{}}
+		room.UsersJoined = slices.DeleteFunc(room.UsersJoined, func(u string) bool { return u == username })
+		room.CoHosts = slices.DeleteFunc(room.CoHosts, func(c CoHost) bool { return c.Username == username })
+		if len(room.CurrentQueue) > 1 {
+			kept := room.CurrentQueue[:1]
+			for _, entry := range room.CurrentQueue[1:] {
+				if entry.Song.Metadata.AddedBy == username {
+					kick.RemovedSongIDs = append(kick.RemovedSongIDs, entry.Song.SongID)
+					continue
+				}
+				kept = append(kept, entry)
+			}
+			room.CurrentQueue = kept
+		}
+		if ban && !slices.Contains(room.Banned, username) {
+			room.Banned = append(room.Banned, username)
+		}
+		if resetPassword {
+			room.Stats.RoomPassword = internal.RandomHash()
+			room.Invite = nil
+			kick.RoomPassword = room.Stats.RoomPassword
+		}
+		return nil
+	})
+	if err != nil {
+		return Kick{}, err
+	}
+	ds.forget(roomID, username)
+	if err := internal.RevokeUserRoomTokens(roomID, username); err != nil {
+		ds.logger.Printf("failed to revoke the tokens of %s in room %s: %v\n", username, roomID, err)
+	}
+	ds.logger.Printf("%s removed %s from room %s (banned: %t)\n", actor, username, roomID, ban)
+	return kick, nil
+}
@@ -0,0 +1,301 @@
+package storage
+
+import (
+	"context"
+	"regexp"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// mongoBackend keeps documents in the BeatBus database
+type mongoBackend struct {
+	db *mongo.Database
+}
+
+func (mb *mongoBackend) findRoom(roomID string) (*Room, error) {
+	return mb.findRoomWhere(bson.M{"roomID": roomID})
+}
+
+func (mb *mongoBackend) findRoomWhere(filter bson.M) (*Room, error) {
+	var room Room
+	err := mb.db.Collection(RoomsCollection).FindOne(context.Background(), filter).Decode(&room)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrRoomDoesntExist
+	} else if err != nil {
+		return nil, err
+	}
+	return &room, nil
+}
+
+func (mb *mongoBackend) roomExists(roomID string) (bool, error) {
+	count, err := mb.db.Collection(RoomsCollection).CountDocuments(context.Background(), bson.M{"roomID": roomID})
+	return count > 0, err
+}
+
+func (mb *mongoBackend) findExpiredRooms(now time.Time) ([]*Room, error) {
+	filter := bson.M{"$expr": bson.M{"$lte": bson.A{roomEnd(), now}}}
+	return mb.findRooms(filter)
+}
+
+func (mb *mongoBackend) findPublicRooms(now time.Time, query PublicRoomQuery) ([]*Room, int, error) {
+	filter := bson.M{
+		"RoomStats.public": true,
+		"$expr":            bson.M{"$gt": bson.A{roomEnd(), now}},
+	}
+	if query.Search != "" {
+		filter["RoomStats.name"] = primitive.Regex{Pattern: regexp.QuoteMeta(query.Search), Options: "i"}
+	}
+	total, err := mb.db.Collection(RoomsCollection).CountDocuments(context.Background(), filter)
+	if err != nil {
+		return nil, 0, err
+	}
+	// the same order as publicRoomOrder
+	sort := bson.D{{Key: "start", Value: -1}, {Key: "roomID", Value: 1}}
+	if query.Sort != SortNewest {
+		sort = append(bson.D{{Key: "users", Value: -1}, {Key: "participants", Value: -1}}, sort...)
+	}
+	usersJoined := bson.M{"$ifNull": bson.A{"$usersJoined", bson.A{}}}
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: filter}},
+		{{Key: "$set", Value: bson.M{
+			"start":        roomStart(),
+			"users":        bson.M{"$size": usersJoined},
+			"participants": bson.M{"$size": bson.M{"$ifNull": bson.A{"$participants", usersJoined}}},
+			"CurrentQueue": bson.M{"$slice": bson.A{bson.M{"$ifNull": bson.A{"$CurrentQueue", bson.A{}}}, 1}},
+		}}},
+		{{Key: "$sort", Value: sort}},
+		{{Key: "$skip", Value: int64(query.Offset)}},
+		{{Key: "$limit", Value: int64(query.Limit)}},
+		{{Key: "$unset", Value: bson.A{"start", "users", "participants", "playedSongs"}}},
+	}
+	cursor, err := mb.db.Collection(RoomsCollection).Aggregate(context.Background(), pipeline)
+	if err != nil {
+		return nil, 0, err
+	}
+	rooms := []*Room{}
+	if err := cursor.All(context.Background(), &rooms); err != nil {
+		return nil, 0, err
+	}
+	return rooms, int(total), nil
+}
+
+// roomStart is Room.StartTime as an aggregation expression
+func roomStart() bson.M {
+	return bson.M{"$ifNull": bson.A{"$RoomStats.startsAt", "$RoomStats.createdAt"}}
+}
+
+// roomEnd is Room.EndTime as an aggregation expression.
+// lifetime is in minutes counted from the start, adding milliseconds to a date gives a date
+func roomEnd() bson.M {
+	return bson.M{"$add": bson.A{roomStart(), bson.M{"$multiply": bson.A{"$RoomStats.lifetime", int64(time.Minute / time.Millisecond)}}}}
+}
+
+func (mb *mongoBackend) findRooms(filter bson.M) ([]*Room, error) {
+	cursor, err := mb.db.Collection(RoomsCollection).Find(context.Background(), filter)
+	if err != nil {
+		return nil, err
+	}
+	var rooms []*Room
+	if err := cursor.All(context.Background(), &rooms); err != nil {
+		return nil, err
+	}
+	return rooms, nil
+}
+
+func (mb *mongoBackend) insertRoom(room *Room) error {
+	_, err := mb.db.Collection(RoomsCollection).InsertOne(context.Background(), room)
+	return err
+}
+
+func (mb *mongoBackend) replaceRoom(room *Room) (bool, error) {
+	next := int64(1)
+	if room.Version != nil {
+		next = *room.Version + 1
+	}
+	replacement := *room
+	replacement.Version = &next
+	res, err := mb.db.Collection(RoomsCollection).ReplaceOne(context.Background(), versionFilter(room), replacement)
+	if err != nil {
+		return false, err
+	}
+	if res.MatchedCount != 1 {
+		return false, nil
+	}
+	room.Version = &next
+	return true, nil
+}
+
+// versionFilter matches the room only while it still has the version it was read with.
+// Rooms created before versioning have no version field until their first versioned write.
+func versionFilter(room *Room) bson.M {
+	if room.Version != nil {
+		return bson.M{"roomID": room.RoomID, "version": *room.Version}
+	}
+	return bson.M{"roomID": room.RoomID, "version": bson.M{"$exists": false}}
+}
+
+func (mb *mongoBackend) deleteRoom(room *Room) (bool, error) {
+	res, err := mb.db.Collection(RoomsCollection).DeleteOne(context.Background(), versionFilter(room))
+	if err != nil {
+		return false, err
+	}
+	return res.DeletedCount == 1, nil
+}
+
+func (mb *mongoBackend) findUser(username string) (*User, error) {
+	var user User
+	err := mb.db.Collection(UsersCollection).FindOne(context.Background(), bson.M{"username": username}).Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrUserNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (mb *mongoBackend) insertUser(user *User) (string, error) {
+	res, err := mb.db.Collection(UsersCollection).InsertOne(context.Background(), user)
+	if err != nil {
+		return "", err
+	}
+	return res.InsertedID.(primitive.ObjectID).Hex(), nil
+}
+
+func (mb *mongoBackend) updateUserPassword(username, hashedPassword string) error {
+	return mb.db.Collection(UsersCollection).FindOneAndUpdate(context.Background(),
+		bson.M{"username": username},
+		bson.M{"$set": bson.M{"password": hashedPassword}},
+	).Err()
+}
+
+func (mb *mongoBackend) insertUserInfo(info *UserInfo) error {
+	_, err := mb.db.Collection(UserInfoCollection).InsertOne(context.Background(), info)
+	return err
+}
+
+func (mb *mongoBackend) findUserInfo(userID string) (*UserInfo, error) {
+	var info UserInfo
+	err := mb.db.Collection(UserInfoCollection).FindOne(context.Background(), bson.M{"user_id": userID}).Decode(&info)
+	if err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+func (mb *mongoBackend) setInSession(userID string, inSession bool) error {
+	return mb.db.Collection(UserInfoCollection).FindOneAndUpdate(context.Background(),
+		bson.M{"user_id": userID},
+		bson.M{"$set": bson.M{"inSession": inSession}},
+	).Err()
+}
+
+func (mb *mongoBackend) claimSession(userID string) (bool, error) {
+	res, err := mb.db.Collection(UserInfoCollection).UpdateOne(context.Background(),
+		bson.M{"user_id": userID, "inSession": bson.M{"$ne": true}},
+		bson.M{"$set": bson.M{"inSession": true}},
+	)
+	if err != nil {
+		return false, err
+	}
+	return res.MatchedCount == 1, nil
+}
+
+func (mb *mongoBackend) addToUserInfo(userID, list, value string) error {
+	return mb.db.Collection(UserInfoCollection).FindOneAndUpdate(context.Background(),
+		bson.M{"user_id": userID},
+		bson.M{"$addToSet": bson.M{list: value}},
+	).Err()
+}
+
+func (mb *mongoBackend) upsertCatalogSong(song *CatalogSong) error {
+	onInsert, err := bson.Marshal(song)
+	if err != nil {
+		return err
+	}
+	var doc bson.M
+	if err := bson.Unmarshal(onInsert, &doc); err != nil {
+		return err
+	}
+	delete(doc, "_id")
+	_, err = mb.db.Collection(SongsCollection).UpdateOne(context.Background(),
+		bson.M{"_id": song.CatalogID},
+		bson.M{"$setOnInsert": doc},
+		options.Update().SetUpsert(true),
+	)
+	return err
+}
+
+func (mb *mongoBackend) findCatalogSong(catalogID string) (*CatalogSong, error) {
+	var song CatalogSong
+	err := mb.db.Collection(SongsCollection).FindOne(context.Background(), bson.M{"_id": catalogID}).Decode(&song)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrSongNotInCatalog
+	} else if err != nil {
+		return nil, err
+	}
+	return &song, nil
+}
+
+func (mb *mongoBackend) insertSession(session *Session) error {
+	_, err := mb.db.Collection(SessionsCollection).InsertOne(context.Background(), session)
+	return err
+}
+
+func (mb *mongoBackend) findSession(sessionID string) (*Session, error) {
+	var session Session
+	err := mb.db.Collection(SessionsCollection).FindOne(context.Background(), bson.M{"_id": sessionID}).Decode(&session)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrSessionNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+func (mb *mongoBackend) findUserSessions(username string) ([]*Session, error) {
+	ctx := context.Background()
+	cursor, err := mb.db.Collection(SessionsCollection).Find(ctx,
+		bson.M{"$or": bson.A{bson.M{"participants": username}, bson.M{"hostID": username}}},
+		options.Find().SetSort(bson.M{"endedAt": -1}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	var sessions []*Session
+	if err := cursor.All(ctx, &sessions); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+func (mb *mongoBackend) recordCatalogPlays(plays []catalogPlay) error {
+	if len(plays) == 0 {
+		return nil
+	}
+	writes := make([]mongo.WriteModel, 0, len(plays))
+	for _, play := range plays {
+		inc := bson.M{
+			"likes":    play.Likes,
+			"dislikes": play.Dislikes,
+		}
+		if play.Played {
+			inc["plays"] = 1
+		} else {
+			inc["skips"] = 1
+		}
+		update := bson.M{
+			"$inc":      inc,
+			"$addToSet": bson.M{"rooms": play.RoomID},
+		}
+		if !play.PlayedAt.IsZero() {
+			update["$max"] = bson.M{"lastPlayedAt": play.PlayedAt}
+		}
+		writes = append(writes, mongo.NewUpdateOneModel().SetFilter(bson.M{"_id": play.CatalogID}).SetUpdate(update))
+	}
+	_, err := mb.db.Collection(SongsCollection).BulkWrite(context.Background(), writes, options.BulkWrite().SetOrdered(false))
+	return err
+}
@@ -0,0 +1,249 @@
+package storage
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"time"
+)
+
+const (
+	QueueModeFIFO = "fifo" // songs play in the order they were added
+	QueueModeFair = "fair" // songs are interleaved round-robin by the user who added them
+	QueueModeVote = "vote" // songs are ordered by likes minus dislikes
+)
+
+var (
+	ErrInvalidQueueMode    = fmt.Errorf("queue mode must be one of [%s, %s, %s]", QueueModeFIFO, QueueModeFair, QueueModeVote)
+	ErrInvalidVoteHalfLife = fmt.Errorf("voteHalfLifeMinutes can't be negative")
+)
+
+// QueueOrdering is the room setting that decides how CurrentQueue is ordered.
+// It is reapplied every time a song is added, voted on or the queue advances.
+type QueueOrdering struct {
+	Mode string `bson:"mode" json:"mode"`
+	// only used in fair mode, users who have waited longest since their last song played go first
+	ByWaitTime bool `bson:"byWaitTime" json:"byWaitTime"`
+	// only used in vote mode, a song's score halves every this many minutes after it was added. 0 turns decay off
+	VoteHalfLifeMinutes int `bson:"voteHalfLifeMinutes" json:"voteHalfLifeMinutes"`
+}
+
+func (qo QueueOrdering) Validate() error {
+	switch qo.Mode {
+	case "", QueueModeFIFO, QueueModeFair, QueueModeVote:
+	default:
+		return ErrInvalidQueueMode
+	}
+	if qo.VoteHalfLifeMinutes < 0 {
+		return ErrInvalidVoteHalfLife
+	}
+	return nil
+}
+
+// orderQueue returns the queue ordered by the room's queue mode.
+// The head of the queue is the song currently playing, so it never moves.
+func orderQueue(room *Room, queue []QueueEntry, now time.Time) []QueueEntry {
+	ordering := room.Stats.Ordering
+	if len(queue) <= 2 {
+		return queue
+	}
+	switch ordering.Mode {
+	case QueueModeFair:
+		return fairShareOrder(queue, room.PlayedSongs, ordering.ByWaitTime, now)
+	case QueueModeVote:
+		return voteOrder(queue, time.Duration(ordering.VoteHalfLifeMinutes)*time.Minute, now)
+	default:
+		// rooms without an ordering are first-come, first-served
+		return queue
+	}
+}
+
+// fairShareOrder interleaves the upcoming songs round-robin by the user who added them.
+// Each user's own songs keep the order they were added in and pinned songs keep their index.
+func fairShareOrder(queue, playedSongs []QueueEntry, byWaitTime bool, now time.Time) []QueueEntry {
+	head := queue[0]
+	upcoming := queue[1:]
+
+	songsByUser := make(map[string][]QueueEntry)
+	var users []string
+	var unpinned []QueueEntry
+	for _, entry := range upcoming {
+		if entry.Pinned {
+			continue
+		}
+		unpinned = append(unpinned, entry)
+	}
+	// users keep their songs in the order they were added, not the order the queue currently has them in
+	slices.SortStableFunc(unpinned, func(a, b QueueEntry) int {
+		return int(a.Position - b.Position)
+	})
+	for _, entry := range unpinned {
+		user := entry.Song.Metadata.AddedBy
+		if _, seen := songsByUser[user]; !seen {
+			users = append(users, user)
+		}
+		songsByUser[user] = append(songsByUser[user], entry)
+	}
+
+	if byWaitTime {
+		waited := make(map[string]time.Duration, len(users))
+		for _, user := range users {
+			waited[user] = userWaitTime(user, head, songsByUser[user], playedSongs, now)
+		}
+		slices.SortStableFunc(users, func(a, b string) int {
+			switch {
+			case waited[a] > waited[b]:
+				return -1
+			case waited[a] < waited[b]:
+				return 1
+			default:
+				return 0
+			}
+		})
+	} else if playing := head.Song.Metadata.AddedBy; songsByUser[playing] != nil {
+		// whoever's song is playing right now goes to the back of the first round
+		users = slices.DeleteFunc(users, func(user string) bool { return user == playing })
+		users = append(users, playing)
+	}
+
+	var roundRobin []QueueEntry
+	for round := 0; len(roundRobin) < len(unpinned); round++ {
+		for _, user := range users {
+			if round < len(songsByUser[user]) {
+				roundRobin = append(roundRobin, songsByUser[user][round])
+			}
+		}
+	}
+
+	return append([]QueueEntry{head}, placeAroundPins(upcoming, roundRobin)...)
+}
+
+// voteOrder sorts the upcoming songs by score, highest first. Songs with the same score keep the order they were added in.
+func voteOrder(queue []QueueEntry, halfLife time.Duration, now time.Time) []QueueEntry {
+	head := queue[0]
+	upcoming := queue[1:]
+
+	var unpinned []QueueEntry
+	scores := make(map[string]float64)
+	for _, entry := range upcoming {
+		if entry.Pinned {
+			continue
+		}
+		unpinned = append(unpinned, entry)
+		scores[entry.Song.SongID] = voteScore(entry, halfLife, now)
+	}
+	slices.SortStableFunc(unpinned, func(a, b QueueEntry) int {
+		scoreA, scoreB := scores[a.Song.SongID], scores[b.Song.SongID]
+		switch {
+		case scoreA > scoreB:
+			return -1
+		case scoreA < scoreB:
+			return 1
+		default:
+			return int(a.Position - b.Position)
+		}
+	})
+	return append([]QueueEntry{head}, placeAroundPins(upcoming, unpinned)...)
+}
+
+// voteScore is likes minus dislikes, halved for every halfLife that has passed since the song was added
+func voteScore(entry QueueEntry, halfLife time.Duration, now time.Time) float64 {
+	metadata := entry.Song.Metadata
+	score := float64(metadata.Likes - metadata.Dislikes)
+	if halfLife <= 0 || metadata.AddedAt.IsZero() {
+		return score
+	}
+	age := now.Sub(metadata.AddedAt)
+	return score * math.Pow(0.5, age.Minutes()/halfLife.Minutes())
+}
+
+// placeAroundPins puts pinned songs back at the index the host gave them and fills the gaps with ordered
+func placeAroundPins(upcoming, ordered []QueueEntry) []QueueEntry {
+	placed := make([]QueueEntry, len(upcoming))
+	filled := make([]bool, len(upcoming))
+	for index, entry := range upcoming {
+		if entry.Pinned {
+			placed[index] = entry
+			filled[index] = true
+		}
+	}
+	next := 0
+	for index := range placed {
+		if filled[index] {
+			continue
+		}
+		placed[index] = ordered[next]
+		next++
+	}
+	return placed
+}
+
+// userWaitTime is how long it has been since one of the user's songs last played.
+// Users who haven't had a song played yet have been waiting since they added their first song.
+func userWaitTime(user string, head QueueEntry, pending, playedSongs []QueueEntry, now time.Time) time.Duration {
+	if head.Song.Metadata.AddedBy == user {
+		return 0
+	}
+	var lastPlayed time.Time
+	for _, entry := range playedSongs {
+		if entry.Song.Metadata.AddedBy != user {
+			continue
+		}
+		if entry.PlayedAt.After(lastPlayed) {
+			lastPlayed = entry.PlayedAt
+		}
+	}
+	if lastPlayed.IsZero() {
+		for _, entry := range pending {
+			if addedAt := entry.Song.Metadata.AddedAt; !addedAt.IsZero() && (lastPlayed.IsZero() || addedAt.Before(lastPlayed)) {
+				lastPlayed = addedAt
+			}
+		}
+	}
+	if lastPlayed.IsZero() {
+		return 0
+	}
+	return now.Sub(lastPlayed)
+}
+
+// pinMovedSongs marks the songs the host moved in a manual reorder as pinned so automatic ordering leaves them be.
+// The songs that kept their relative order form the longest increasing run of old positions, the rest were moved.
+func pinMovedSongs(oldQueue, newQueue []QueueEntry) {
+	oldIndex := make(map[string]int, len(oldQueue))
+	for index, entry := range oldQueue {
+		oldIndex[entry.Song.SongID] = index
+	}
+	sequence := make([]int, len(newQueue))
+	for index, entry := range newQueue {
+		sequence[index] = oldIndex[entry.Song.SongID]
+	}
+	keptOrder := longestIncreasingRun(sequence)
+	for index := range newQueue {
+		if !keptOrder[index] {
+			newQueue[index].Pinned = true
+		}
+	}
+}
+
+// longestIncreasingRun flags the indexes of sequence that belong to its longest strictly increasing subsequence
+func longestIncreasingRun(sequence []int) []bool {
+	length := make([]int, len(sequence))
+	previous := make([]int, len(sequence))
+	best := -1
+	for i := range sequence {
+		length[i], previous[i] = 1, -1
+		for j := 0; j < i; j++ {
+			if sequence[j] < sequence[i] && length[j]+1 > length[i] {
+				length[i], previous[i] = length[j]+1, j
+			}
+		}
+		if best == -1 || length[i] > length[best] {
+			best = i
+		}
+	}
+	kept := make([]bool, len(sequence))
+	for i := best; i >= 0; i = previous[i] {
+		kept[i] = true
+	}
+	return kept
+}
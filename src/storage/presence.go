@@ -0,0 +1,106 @@
+package storage
+
+import (
+	"BeatBus/internal"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// PresenceTimeout is how long a user counts as active after they were last seen.
+// Open state streams refresh it, other clients call the heartbeat endpoint more often than this.
+const PresenceTimeout = time.Minute
+
+var ErrHostCantLeave = fmt.Errorf("the host can't leave the room, hand it over or end the session instead")
+
+// WithPresence makes the store count only active users toward capacity, skip votes and the room size
+// clients see. Without it everyone who is in the room counts as active.
+func (ds *DocumentStore) WithPresence(presence Presence) *DocumentStore {
+	ds.presence = presence
+	return ds
+}
+
+// activeUsers returns the users in the room that have been seen within PresenceTimeout
+func (ds *DocumentStore) activeUsers(room *Room) []string {
+	if ds.presence == nil {
+		return room.UsersJoined
+	}
+	seen, err := ds.presence.SeenSince(room.RoomID, time.Now().Add(-PresenceTimeout))
+	if err != nil {
+		ds.logger.Printf("failed to read presence of room %s, counting everyone as active: %v\n", room.RoomID, err)
+		return room.UsersJoined
+	}
+	active := []string{}
+	for _, username := range room.UsersJoined {
+		if slices.Contains(seen, username) {
+			active = append(active, username)
+		}
+	}
+	return active
+}
+
+func (ds *DocumentStore) touch(roomID, username string) {
+	if ds.presence == nil {
+		return
+	}
+	if err := ds.presence.Touch(roomID, username, time.Now()); err != nil {
+		ds.logger.Printf("failed to record that %s is in room %s: %v\n", username, roomID, err)
+	}
+}
+
+func (ds *DocumentStore) forget(roomID, username string) {
+	if ds.presence == nil {
+		return
+	}
+	if err := ds.presence.Forget(roomID, username); err != nil {
+		ds.logger.Printf("failed to forget %s in room %s: %v\n", username, roomID, err)
+	}
+}
+
+// participantsOf is everyone who ever joined the room, rooms from before participants were kept only know who is in them now
+func participantsOf(room *Room) []string {
+	participants := slices.Clone(room.Participants)
+	for _, username := range append([]string{room.HostID}, room.UsersJoined...) {
+		if !slices.Contains(participants, username) {
+			participants = append(participants, username)
+		}
+	}
+	return participants
+}
+
+// Heartbeat marks username as active in the room, ErrUserNotInRoom if they left or were kicked
+func (ds *DocumentStore) Heartbeat(roomID, username string) error {
+	room, err := ds.findRoom(roomID)
+	if err != nil {
+		return err
+	}
+	if !slices.Contains(room.UsersJoined, username) {
+		return ErrUserNotInRoom
+	}
+	ds.touch(roomID, username)
+	return nil
+}
+
+// LeaveRoom takes username out of the room and revokes their tokens for it, the same as a kick.
+// Their songs stay in the queue and they can join again later.
+func (ds *DocumentStore) LeaveRoom(roomID, username string) error {
+	err := ds.updateRoomVersioned(roomID, func(room *Room) error {
+		if room.HostID == username {
+			return ErrHostCantLeave
+		}
+		if !slices.Contains(room.UsersJoined, username) {
+			return ErrUserNotInRoom
+		}
+		room.UsersJoined = slices.DeleteFunc(room.UsersJoined, func(u string) bool { return u == username })
+		room.CoHosts = slices.DeleteFunc(room.CoHosts, func(c CoHost) bool { return c.Username == username })
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	ds.forget(roomID, username)
+	if err := internal.RevokeUserRoomTokens(roomID, username); err != nil {
+		ds.logger.Printf("failed to revoke the tokens of %s in room %s: %v\n", username, roomID, err)
+	}
+	return nil
+}
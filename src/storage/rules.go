@@ -0,0 +1,91 @@
+package storage
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// DefaultSkipVoteShare is the share of the room that has to vote to skip a song when the host hasn't picked one
+const DefaultSkipVoteShare = 0.5
+
+var (
+	ErrInvalidRoomRules        = fmt.Errorf("room rules can't be negative and skipVoteShare can't be more than 1")
+	ErrTooManyPendingSongs     = fmt.Errorf("you already have the maximum number of songs waiting in the queue")
+	ErrTooManyConsecutiveSongs = fmt.Errorf("you already have the maximum number of songs in a row at the end of the queue")
+	ErrAddSongCooldown         = fmt.Errorf("you are adding songs too quickly")
+)
+
+// RoomRules are set by the host to stop a single user from taking over the queue.
+// A zero value means the rule is turned off.
+type RoomRules struct {
+	MaxPendingPerUser     int `bson:"maxPendingPerUser" json:"maxPendingPerUser"`         // songs a user can have waiting at once
+	MaxConsecutivePerUser int `bson:"maxConsecutivePerUser" json:"maxConsecutivePerUser"` // songs by the same user in a row
+	CooldownSeconds       int `bson:"cooldownSeconds" json:"cooldownSeconds"`             // time a user must wait between adds
+	// share of the users in the room that have to vote to skip the current song, 0 uses DefaultSkipVoteShare
+	SkipVoteShare float64 `bson:"skipVoteShare" json:"skipVoteShare"`
+}
+
+func (rr RoomRules) Validate() error {
+	if rr.MaxPendingPerUser < 0 || rr.MaxConsecutivePerUser < 0 || rr.CooldownSeconds < 0 || rr.SkipVoteShare < 0 || rr.SkipVoteShare > 1 {
+		return ErrInvalidRoomRules
+	}
+	return nil
+}
+
+// checkRoomRules returns an error if adding a song for addedBy right now would break one of the room's rules.
+// The song at the head of the queue is already playing, so it doesn't count as pending.
+func checkRoomRules(room *Room, addedBy string, now time.Time) error {
+	rules := room.Stats.Rules
+	currentQueue := room.CurrentQueue
+
+	if rules.MaxPendingPerUser > 0 && len(currentQueue) > 1 {
+		pending := 0
+		for _, entry := range currentQueue[1:] {
+			if entry.Song.Metadata.AddedBy == addedBy {
+				pending++
+			}
+		}
+		if pending >= rules.MaxPendingPerUser {
+			return fmt.Errorf("%w (limit is %d)", ErrTooManyPendingSongs, rules.MaxPendingPerUser)
+		}
+	}
+
+	if rules.MaxConsecutivePerUser > 0 {
+		inARow := 0
+		for i := len(currentQueue) - 1; i >= 0 && currentQueue[i].Song.Metadata.AddedBy == addedBy; i-- {
+			inARow++
+		}
+		if inARow >= rules.MaxConsecutivePerUser {
+			return fmt.Errorf("%w (limit is %d)", ErrTooManyConsecutiveSongs, rules.MaxConsecutivePerUser)
+		}
+	}
+
+	if rules.CooldownSeconds > 0 {
+		var lastAdded time.Time
+		for _, entries := range [][]QueueEntry{currentQueue, room.PlayedSongs} {
+			for _, entry := range entries {
+				if entry.Song.Metadata.AddedBy != addedBy {
+					continue
+				}
+				if addedAt := entry.Song.Metadata.AddedAt; addedAt.After(lastAdded) {
+					lastAdded = addedAt
+				}
+			}
+		}
+		cooldown := time.Duration(rules.CooldownSeconds) * time.Second
+		if wait := lastAdded.Add(cooldown).Sub(now); !lastAdded.IsZero() && wait > 0 {
+			return fmt.Errorf("%w, please wait %d more seconds", ErrAddSongCooldown, int(wait.Seconds())+1)
+		}
+	}
+	return nil
+}
+
+// skipVotesNeeded is how many votes it takes to skip a song in a room of roomSize users, never less than one
+func skipVotesNeeded(rules RoomRules, roomSize int) int {
+	share := rules.SkipVoteShare
+	if share == 0 {
+		share = DefaultSkipVoteShare
+	}
+	return max(1, int(math.Ceil(share*float64(roomSize))))
+}
@@ -0,0 +1,141 @@
+package storage
+
+import (
+	"BeatBus/events"
+	"BeatBus/internal"
+	"time"
+)
+
+// RoomStore runs rooms and their queues. *DocumentStore implements it on top of either Mongo or memory.
+type RoomStore interface {
+	CreateRoom(hostUsername, roomName string, lifetime, maxUsers uint, public bool, rules RoomRules, ordering QueueOrdering, startsAt time.Time) (CreatedRoom, error)
+	UpdateRoomSettings(roomID, hostUsername, roomName string, lifetime, maxUsers uint, public bool, rules RoomRules, ordering QueueOrdering) (UpdatedRoom, error)
+	DeleteRoom(hostUsername, roomID string) (SessionSummary, error)
+	RoomExist(roomID string) bool
+	EndExpiredRooms(now time.Time) ([]string, error)
+	AddUserToRoom(roomID, roomPassword, username string) (time.Duration, error)
+	CheckRoomPassword(roomID, roomPassword string) error
+	RoomState(roomID string) (RoomSnapshot, error)
+
+	RoomRole(roomID, username string) (RoomRole, error)
+	RoomToken(roomID, username string) (AccessToken, RoomRole, error)
+	SetCoHost(roomID, hostUsername, username string, permissions []string) ([]CoHost, error)
+	RemoveCoHost(roomID, hostUsername, username string) ([]CoHost, error)
+	TransferHost(roomID, hostUsername, newHost string) (HostTransfer, error)
+	KickUser(roomID, actor, username string, ban, resetPassword bool) (Kick, error)
+	CreateInvite(roomID, hostUsername string, ttl time.Duration, maxUses int64) (Invite, error)
+	CurrentInvite(roomID, hostUsername string) (Invite, error)
+	AddUserWithInvite(roomID, inviteID, username string) (time.Duration, error)
+	PublicRooms(query PublicRoomQuery) (PublicRoomPage, error)
+	LeaveRoom(roomID, username string) error
+	Heartbeat(roomID, username string) error
+
+	AddSongToQueue(roomID string, song Song, externalID string) error
+	GetCurrentQueue(roomID string) ([]QueueEntry, error)
+	UpdateQueue(roomID string, newQueue []string) ([]QueueEntry, error)
+	SongOperation(roomID, songID, userID, operation string) (SongVote, []string, error)
+	NextSong(roomID string) (string, string, error)
+	VoteToSkip(roomID, username string) (SkipVote, error)
+
+	RoomMetrics(roomID string) (RoomMetricsSnapshot, error)
+	QueueHistory(roomID string) ([]QueueEntry, error)
+	GetRoomsPlaylist(roomID string) ([]QueueEntry, []QueueEntry, error)
+	GetCatalogSong(catalogID string) (CatalogSong, error)
+
+	GetSession(sessionID string) (Session, error)
+	UserSessions(username string) ([]Session, error)
+}
+
+// UserStore keeps registered users
+type UserStore interface {
+	InsertNewUser(username, password string) error
+	ValidateUser(username, password string) error // ErrInvalidCredentials if the password doesn't match
+	UserExists(username string) (bool, error)
+}
+
+// Broker is everything kept outside the document store: room events, throttling keys, presence and revoked tokens.
+// Redis (NewMessageQueue) and memory (NewMemoryBus) both provide all of it.
+type Broker interface {
+	EventBus
+	Cache
+	Presence
+	internal.TokenStore
+}
+
+// EventBus carries room events to live subscribers and keeps a log of them that can be replayed
+type EventBus interface {
+	UpdateChannel(channel string, event events.Event) error
+	ReadEvents(channel, afterID string) ([]events.Event, error)
+	LastEventID(channel string) (string, error)
+	SubscribeChannel(channel string) (Subscription, error)
+}
+
+// Subscription delivers the events published to a channel after it was opened.
+// Events is closed once the subscription is closed or the bus goes away.
+type Subscription interface {
+	Events() <-chan events.Event
+	Close() error
+}
+
+// Cache holds the short lived keys used to throttle requests
+type Cache interface {
+	EnsureKeyExists(key string) error
+	GetKey(key string) (string, error) // ErrKeyDoesNotExist if it isn't set
+	SetKeyWithExpiry(key string, value interface{}, expiration time.Duration) error
+	Incr(key string) error
+}
+
+// Presence remembers when users were last seen in a room so people who went home stop counting as there
+type Presence interface {
+	Touch(roomID, username string, at time.Time) error
+	Forget(roomID, username string) error
+	SeenSince(roomID string, since time.Time) ([]string, error) // users seen at or after since
+}
+
+// backend is where a DocumentStore keeps its documents. Rooms are only ever written whole and only
+// if nobody wrote them since they were read, which is what keeps concurrent queue changes safe.
+type backend interface {
+	findRoom(roomID string) (*Room, error) // ErrRoomDoesntExist if there isn't one
+	roomExists(roomID string) (bool, error)
+	findExpiredRooms(now time.Time) ([]*Room, error) // rooms whose lifetime ran out by now
+	// findPublicRooms returns the page query asks for of the public rooms still running at now, named like
+	// query.Search ignoring case and ordered by publicRoomOrder, along with how many match across all pages.
+	// Rooms in the page carry only the song playing and no played songs.
+	findPublicRooms(now time.Time, query PublicRoomQuery) ([]*Room, int, error)
+	insertRoom(room *Room) error
+	// replaceRoom writes room if its stored version still matches room.Version and bumps the version.
+	// It reports false without writing anything when the room changed since it was read.
+	replaceRoom(room *Room) (bool, error)
+	// deleteRoom deletes room under the same condition as replaceRoom, it reports false when the room
+	// changed or was deleted since it was read
+	deleteRoom(room *Room) (bool, error)
+
+	findUser(username string) (*User, error) // ErrUserNotFound if there isn't one
+	insertUser(user *User) (string, error)
+	updateUserPassword(username, hashedPassword string) error
+	insertUserInfo(info *UserInfo) error
+	findUserInfo(userID string) (*UserInfo, error)
+	setInSession(userID string, inSession bool) error
+	// claimSession sets inSession only if it isn't set yet, it reports false when the user already hosts a room
+	claimSession(userID string) (bool, error)
+	// addToUserInfo adds value to one of the user info lists, like liked_songs
+	addToUserInfo(userID, list, value string) error
+
+	upsertCatalogSong(song *CatalogSong) error // only inserts, an existing song is left as is
+	findCatalogSong(catalogID string) (*CatalogSong, error)
+	recordCatalogPlays(plays []catalogPlay) error
+
+	insertSession(session *Session) error
+	findSession(sessionID string) (*Session, error)       // ErrSessionNotFound if there isn't one
+	findUserSessions(username string) ([]*Session, error) // sessions the user hosted or joined, newest first
+}
+
+// catalogPlay is what one session adds to a catalog song's stats
+type catalogPlay struct {
+	CatalogID string
+	RoomID    string
+	Played    bool // false when the song was skipped
+	Likes     int
+	Dislikes  int
+	PlayedAt  time.Time
+}